@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+type AlertEventType string
+
+var (
+	AlertCrashed      AlertEventType = "crashed"
+	AlertRestartLoop  AlertEventType = "restart-loop"
+	AlertUnhealthy    AlertEventType = "unhealthy"
+	AlertRSS          AlertEventType = "rss"
+	AlertCPU          AlertEventType = "cpu"
+	AlertUploadFailed AlertEventType = "upload-failed"
+)
+
+var alertEventTypes = []AlertEventType{AlertCrashed, AlertRestartLoop, AlertUnhealthy, AlertRSS, AlertCPU, AlertUploadFailed}
+
+// AlertEvent is what the message templates are executed with.
+type AlertEvent struct {
+	// Name is the name of the emu instance from the config.
+	Name    string         `json:"name"`
+	Service string         `json:"service"`
+	Event   AlertEventType `json:"event"`
+	Message string         `json:"message"`
+	Time    time.Time      `json:"time"`
+}
+
+type AlertConfig struct {
+	// Cooldown is how long the same event of the same service is not sent again, 10m by default.
+	Cooldown  time.Duration     `yaml:"cooldown,omitempty" json:"cooldown"`
+	Rules     []*AlertRule      `yaml:"rules" json:"rules"`
+	Notifiers []*NotifierConfig `yaml:"notifiers" json:"notifiers"`
+}
+
+// AlertRule selects the events to send. rss and cpu rules fire when the
+// usage stays over the threshold for the given duration.
+type AlertRule struct {
+	Event AlertEventType `yaml:"event" json:"event"`
+	// Services limits the rule to some services, all by default.
+	Services []string `yaml:"services,omitempty" json:"services"`
+	// Threshold is in megabytes for rss and in percent for cpu.
+	Threshold float64       `yaml:"threshold,omitempty" json:"threshold"`
+	For       time.Duration `yaml:"for,omitempty" json:"for"`
+}
+
+type NotifierConfig struct {
+	// Type is one of webhook, slack or email.
+	Type    string            `yaml:"type" json:"type"`
+	URL     string            `yaml:"url,omitempty" json:"-"`
+	Headers map[string]string `yaml:"headers,omitempty" json:"-"`
+	// Template is a text/template executed with an AlertEvent.
+	Template string `yaml:"template,omitempty" json:"template"`
+
+	// SMTP is the host:port of the mail server.
+	SMTP     string   `yaml:"smtp,omitempty" json:"smtp"`
+	Username string   `yaml:"username,omitempty" json:"username"`
+	Password string   `yaml:"password,omitempty" json:"-"`
+	From     string   `yaml:"from,omitempty" json:"from"`
+	To       []string `yaml:"to,omitempty" json:"to"`
+}
+
+const defaultAlertTemplate = "[{{.Name}}] {{.Service}} {{.Event}}: {{.Message}}"
+
+func (c *AlertConfig) cooldown() time.Duration {
+	if c.Cooldown > 0 {
+		return c.Cooldown
+	}
+	return 10 * time.Minute
+}
+
+func (c *AlertConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, rule := range c.Rules {
+		if !lo.Contains(alertEventTypes, rule.Event) {
+			return fmt.Errorf("unknown alert event %q", rule.Event)
+		}
+		if (rule.Event == AlertRSS || rule.Event == AlertCPU) && rule.Threshold <= 0 {
+			return fmt.Errorf("%s alert needs a threshold", rule.Event)
+		}
+	}
+	for _, n := range c.Notifiers {
+		if err := n.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NotifierConfig) Validate() error {
+	if _, err := template.New("alert").Parse(n.Template); err != nil {
+		return err
+	}
+	switch n.Type {
+	case "webhook", "slack":
+		if n.URL == "" {
+			return fmt.Errorf("%s notifier needs an url", n.Type)
+		}
+		return nil
+	case "email":
+		if n.SMTP == "" || n.From == "" || len(n.To) == 0 {
+			return fmt.Errorf("email notifier needs smtp, from and to")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown notifier type %q", n.Type)
+}
+
+func (n *NotifierConfig) render(event AlertEvent) string {
+	text := n.Template
+	if text == "" {
+		text = defaultAlertTemplate
+	}
+	var buf bytes.Buffer
+	if err := template.Must(template.New("alert").Parse(text)).Execute(&buf, event); err != nil {
+		return fmt.Sprintf("%s %s: %s", event.Service, event.Event, event.Message)
+	}
+	return buf.String()
+}
+
+func (n *NotifierConfig) Send(event AlertEvent) error {
+	text := n.render(event)
+	switch n.Type {
+	case "slack":
+		return postJSON(n.URL, n.Headers, map[string]string{"text": text})
+	case "email":
+		host := strings.Split(n.SMTP, ":")[0]
+		var auth smtp.Auth
+		if n.Username != "" {
+			auth = smtp.PlainAuth("", n.Username, n.Password, host)
+		}
+		subject := strings.SplitN(text, "\n", 2)[0]
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+			n.From, strings.Join(n.To, ", "), subject, text)
+		return smtp.SendMail(n.SMTP, auth, n.From, n.To, []byte(msg))
+	}
+	return postJSON(n.URL, n.Headers, struct {
+		AlertEvent
+		Text string `json:"text"`
+	}{event, text})
+}
+
+// Alerts sends the events matching the configured rules to the notifiers,
+// at most once per cooldown for the same service and event.
+type Alerts struct {
+	lock   sync.Mutex
+	name   string
+	config *AlertConfig
+	sent   map[string]time.Time
+	// over is when a service went over the threshold of a rule
+	over map[*AlertRule]map[string]time.Time
+}
+
+var alerts = Alerts{}
+
+func (a *Alerts) Configure(config *Config) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.name = config.Name
+	a.config = config.Alerts
+	a.over = map[*AlertRule]map[string]time.Time{}
+	if a.sent == nil {
+		a.sent = map[string]time.Time{}
+	}
+}
+
+func (rule *AlertRule) matches(service string, event AlertEventType) bool {
+	exec, _ := splitID(service)
+	return rule.Event == event && (len(rule.Services) == 0 || lo.Contains(rule.Services, service) || lo.Contains(rule.Services, exec))
+}
+
+// Fire sends the event if a rule asks for it.
+func (a *Alerts) Fire(service string, event AlertEventType, message string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.config == nil {
+		return
+	}
+	if _, ok := lo.Find(a.config.Rules, func(rule *AlertRule) bool { return rule.matches(service, event) }); !ok {
+		return
+	}
+	a.send(service, event, message)
+}
+
+// send notifies unless the same event was sent during the cooldown, the caller holds a.lock.
+func (a *Alerts) send(service string, event AlertEventType, message string) {
+	key := service + "/" + string(event)
+	if time.Since(a.sent[key]) < a.config.cooldown() {
+		return
+	}
+	a.sent[key] = time.Now()
+	alert := AlertEvent{Name: a.name, Service: service, Event: event, Message: message, Time: time.Now()}
+	for _, n := range a.config.Notifiers {
+		go func(n *NotifierConfig) {
+			if err := n.Send(alert); err != nil {
+				fmt.Println("failed to send alert to", n.Type, "notifier:", err)
+			}
+		}(n)
+	}
+}
+
+// Check fires the rss and cpu rules the sample goes over.
+func (a *Alerts) Check(service string, sample Sample) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.config == nil {
+		return
+	}
+	for _, rule := range a.config.Rules {
+		var value float64
+		var message string
+		switch {
+		case rule.matches(service, AlertRSS):
+			value = float64(sample.RSS) / (1 << 20)
+			message = fmt.Sprintf("rss %.0fMB over %.0fMB", value, rule.Threshold)
+		case rule.matches(service, AlertCPU):
+			value = sample.CPU
+			message = fmt.Sprintf("cpu %.1f%% over %.1f%%", value, rule.Threshold)
+		default:
+			continue
+		}
+		if a.over[rule] == nil {
+			a.over[rule] = map[string]time.Time{}
+		}
+		if value <= rule.Threshold {
+			delete(a.over[rule], service)
+			continue
+		}
+		since, ok := a.over[rule][service]
+		if !ok {
+			since = sample.Time
+			a.over[rule][service] = since
+		}
+		if sample.Time.Sub(since) >= rule.For {
+			if rule.For > 0 {
+				message += " for " + rule.For.String()
+			}
+			a.send(service, rule.Event, message)
+		}
+	}
+}
+
+// UploadFailed fires upload-failed when err is not nil.
+func (a *Alerts) UploadFailed(service string, err error) {
+	if err != nil {
+		a.Fire(service, AlertUploadFailed, err.Error())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Service string    `json:"service"`
+	Action  string    `json:"action"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+type AuditFilter struct {
+	Service string
+	User    string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f AuditFilter) Match(entry *AuditEntry) bool {
+	if f.Service != "" && entry.Service != f.Service {
+		return false
+	}
+	if f.User != "" && entry.User != f.User {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only file with one JSON entry per line.
+type AuditLog struct {
+	lock sync.Mutex
+	file string
+}
+
+var audit = AuditLog{file: "audit.log"}
+
+func (a *AuditLog) Append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	f, err := os.OpenFile(a.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Query returns the latest entries matching the filter, oldest first.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entries := []AuditEntry{}
+	f, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !filter.Match(&entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) > filter.Limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Audit records a control-plane action made through the request.
+func Audit(r *http.Request, action string, detail string, err error) {
+	user := GetUser(r)
+	entry := AuditEntry{
+		Time:    time.Now(),
+		User:    user,
+		Action:  action,
+		Outcome: "ok",
+		Detail:  detail,
+	}
+	if service, ok := r.Context().Value(serviceKey{}).(*Service); ok {
+		entry.Service = service.Exec
+	}
+	if err != nil {
+		entry.Outcome = "error"
+		entry.Error = err.Error()
+	}
+	if err := audit.Append(entry); err != nil {
+		fmt.Println("failed to write audit log", err)
+	}
+}
+
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Service: query.Get("service"),
+		User:    query.Get("user"),
+		Limit:   100,
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			render.JSON(w, r, NewError(err))
+			return
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			render.JSON(w, r, NewError(err))
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			render.JSON(w, r, NewError(err))
+			return
+		}
+	}
+	entries, err := audit.Query(filter)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(entries))
+}
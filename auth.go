@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrTokenNotFound = fmt.Errorf("token not found")
+
+func isHashed(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// CheckPassword accepts bcrypt hashes, generated with `emu passwd`, and
+// plaintext passwords from older configs.
+func (a *BasicAuth) CheckPassword(password string) bool {
+	if isHashed(a.Password) {
+		return bcrypt.CompareHashAndPassword([]byte(a.Password), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(a.Password), []byte(password)) == 1
+}
+
+// passwd prints the bcrypt hash of the password given as argument or on stdin.
+func passwd(args []string) error {
+	var password string
+	if len(args) > 0 {
+		password = args[0]
+	} else {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+type Token struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	Hash     string    `json:"hash"`
+}
+
+// TokenView is a token as shown by the API, without its hash.
+type TokenView struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	Token    string    `json:"token,omitempty"`
+}
+
+func (t *Token) View() TokenView {
+	return TokenView{ID: t.ID, Name: t.Name, User: t.User, Created: t.Created, LastUsed: t.LastUsed}
+}
+
+// TokenStore keeps API tokens in a JSON file, only their sha256 hashes are stored.
+type TokenStore struct {
+	lock   sync.Mutex
+	file   string
+	tokens []*Token
+	loaded bool
+}
+
+var tokens = TokenStore{file: "tokens.json"}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *TokenStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.tokens = []*Token{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.tokens); err != nil {
+			return err
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *TokenStore) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.file+".tmp", s.file)
+}
+
+// Create returns the new token along with its secret, which is never shown again.
+func (s *TokenStore) Create(user string, name string) (TokenView, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return TokenView{}, err
+	}
+	id, err := randomHex(4)
+	if err != nil {
+		return TokenView{}, err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return TokenView{}, err
+	}
+	secret = "emu_" + id + secret
+	token := &Token{ID: id, Name: name, User: user, Created: time.Now(), Hash: hashToken(secret)}
+	s.tokens = append(s.tokens, token)
+	if err := s.save(); err != nil {
+		return TokenView{}, err
+	}
+	view := token.View()
+	view.Token = secret
+	return view, nil
+}
+
+// List returns the tokens of the user, or every token when user is empty.
+func (s *TokenStore) List(user string) ([]TokenView, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	views := []TokenView{}
+	for _, t := range s.tokens {
+		if user == "" || t.User == user {
+			views = append(views, t.View())
+		}
+	}
+	return views, nil
+}
+
+// Revoke deletes the token if it belongs to the user, or to anyone when user is empty.
+func (s *TokenStore) Revoke(user string, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	for i, t := range s.tokens {
+		if t.ID == id && (user == "" || t.User == user) {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// Lookup returns the user owning the token.
+func (s *TokenStore) Lookup(secret string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		fmt.Println("failed to load tokens", err)
+		return "", false
+	}
+	hash := hashToken(secret)
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			t.LastUsed = time.Now()
+			return t.User, true
+		}
+	}
+	return "", false
+}
+
+type userKey struct{}
+
+func GetUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// Authenticate accepts basic auth with an account of the config, or a bearer API token.
+func Authenticate(realm string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := GetConfig(r)
+			user, ok := "", false
+			if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+				user, ok = tokens.Lookup(strings.TrimPrefix(bearer, "Bearer "))
+				ok = ok && config.Account(user) != nil
+			} else if username, password, hasAuth := r.BasicAuth(); hasAuth {
+				account := config.Account(username)
+				user, ok = username, account != nil && account.CheckPassword(password)
+			}
+			if !ok {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), userKey{}, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// tokenOwner is the user whose tokens the request may manage, admins manage everyone's.
+func tokenOwner(r *http.Request) string {
+	user := GetUser(r)
+	if GetConfig(r).RoleOf(user, "").Allows(RoleAdmin) {
+		return ""
+	}
+	return user
+}
+
+func ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	views, err := tokens.List(tokenOwner(r))
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(views))
+}
+
+func CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	view, err := tokens.Create(GetUser(r), body.Name)
+	Audit(r, "create-token", view.ID, err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(view))
+}
+
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := tokens.Revoke(tokenOwner(r), id)
+	Audit(r, "revoke-token", id, err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(nil))
+}
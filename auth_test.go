@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		stored   string
+		password string
+		want     bool
+	}{
+		{string(hash), "secret", true},
+		{string(hash), "Secret", false},
+		{string(hash), string(hash), false},
+		{"secret", "secret", true},
+		{"secret", "secre", false},
+		{"secret", "", false},
+	}
+	for _, tt := range tests {
+		account := &BasicAuth{Username: "a", Password: tt.stored}
+		if got := account.CheckPassword(tt.password); got != tt.want {
+			t.Errorf("CheckPassword(%q) against %q = %v, want %v", tt.password, tt.stored, got, tt.want)
+		}
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	store := &TokenStore{file: file}
+
+	alice, err := store.Create("alice", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := store.Create("bob", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(alice.Token, "emu_"+alice.ID) {
+		t.Errorf("token %q does not start with its id %q", alice.Token, alice.ID)
+	}
+	if user, ok := store.Lookup(alice.Token); !ok || user != "alice" {
+		t.Errorf("Lookup = %q, %v, want alice", user, ok)
+	}
+	if _, ok := store.Lookup(alice.Token + "x"); ok {
+		t.Error("Lookup accepted a wrong token")
+	}
+
+	// only the hashes are stored, and the store is read back from the file
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), alice.Token) {
+		t.Error("the token secret was written to the file")
+	}
+	reloaded := &TokenStore{file: file}
+	if user, ok := reloaded.Lookup(bob.Token); !ok || user != "bob" {
+		t.Errorf("Lookup after reload = %q, %v, want bob", user, ok)
+	}
+
+	if views, _ := store.List("alice"); len(views) != 1 || views[0].ID != alice.ID || views[0].Token != "" {
+		t.Errorf("List(alice) = %+v", views)
+	}
+	if views, _ := store.List(""); len(views) != 2 {
+		t.Errorf("List() returned %d tokens, want 2", len(views))
+	}
+
+	// users only revoke their own tokens, admins revoke anyone's
+	if err := store.Revoke("bob", alice.ID); err != ErrTokenNotFound {
+		t.Errorf("Revoke of another user's token = %v, want %v", err, ErrTokenNotFound)
+	}
+	if err := store.Revoke("alice", alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Revoke("", bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Lookup(alice.Token); ok {
+		t.Error("Lookup accepted a revoked token")
+	}
+	if views, _ := store.List(""); len(views) != 0 {
+		t.Errorf("List() returned %d tokens after revoking them all", len(views))
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	config := &Config{Accounts: []*BasicAuth{{Username: "alice", Password: string(hash)}}}
+	file, loaded := tokens.file, tokens.loaded
+	defer func() { tokens.file, tokens.loaded = file, loaded }()
+	tokens.file, tokens.loaded = filepath.Join(t.TempDir(), "tokens.json"), false
+	valid, _ := tokens.Create("alice", "ci")
+	orphan, _ := tokens.Create("removed", "ci")
+
+	handler := WithConfig(func() *Config { return config })(Authenticate("emu")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(GetUser(r)))
+	})))
+	tests := []struct {
+		name   string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"password", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, http.StatusUnauthorized},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, http.StatusUnauthorized},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+valid.Token) }, http.StatusOK},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer emu_nope") }, http.StatusUnauthorized},
+		// tokens of accounts removed from the config are refused
+		{"orphan token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+orphan.Token) }, http.StatusUnauthorized},
+		{"anonymous", func(r *http.Request) {}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		tt.auth(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && w.Body.String() != "alice" {
+			t.Errorf("%s: user %q, want alice", tt.name, w.Body.String())
+		}
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
@@ -25,6 +28,25 @@ func readConfigFromFile(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := config.validateRoles(); err != nil {
+		return nil, err
+	}
+	if err := config.validateServices(); err != nil {
+		return nil, err
+	}
+	if err := config.validateDependencies(); err != nil {
+		return nil, err
+	}
+	if err := config.validateJobs(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range config.Accounts {
+		if !isHashed(a.Password) {
+			fmt.Println("warning: account", a.Username, "has a plaintext password, use `emu passwd` to hash it")
+		}
+	}
+
 	if config.MetaVars == nil {
 		config.MetaVars = map[string]string{}
 	}
@@ -34,7 +56,7 @@ func readConfigFromFile(configPath string) (*Config, error) {
 		return len(keys[i]) > len(keys[j])
 	})
 
-	for _, s := range config.Services {
+	for _, s := range append(config.Services, lo.Map(config.Jobs, func(j *Job, i int) *Service { return &j.Service })...) {
 		s.Env = lo.Map(s.Env, func(env string, i int) string {
 			for _, key := range keys {
 				env = strings.ReplaceAll(env, key, config.MetaVars[key])
@@ -43,6 +65,12 @@ func readConfigFromFile(configPath string) (*Config, error) {
 		})
 	}
 
+	config.Services = expandReplicas(config.Services)
+	for _, j := range config.Jobs {
+		j.Args = j.replaceVars(j.Args)
+		j.Env = j.replaceVars(j.Env)
+	}
+
 	return &config, err
 }
 
@@ -54,7 +82,11 @@ func mkdir() {
 
 type BasicAuth struct {
 	Username string `yaml:"username" json:"username"`
-	Password string `yaml:"password" json:"password"`
+	// Password is a bcrypt hash generated by `emu passwd`, plaintext is still accepted.
+	Password string `yaml:"password" json:"-"`
+
+	Role   Role            `yaml:"role,omitempty" json:"role"`
+	Grants map[string]Role `yaml:"grants,omitempty" json:"grants"`
 }
 
 type Config struct {
@@ -63,6 +95,17 @@ type Config struct {
 	Port     int          `yaml:"port" json:"port"`
 	Services []*Service   `yaml:"services" json:"services"`
 	Mode     Mode         `yaml:"mode" json:"mode"`
+	// Jobs run on a cron schedule instead of all the time.
+	Jobs []*Job `yaml:"jobs,omitempty" json:"jobs"`
+
+	// LogMaxTotalSize caps the size of log/ in megabytes, the oldest rotated files are removed first.
+	LogMaxTotalSize int `yaml:"log-max-total-size,omitempty" json:"logMaxTotalSize"`
+	// Sinks receive the output of every service.
+	Sinks []*SinkConfig `yaml:"sinks,omitempty" json:"sinks"`
+	// Stats sets how often the resource usage of services is sampled and how long it is kept.
+	Stats *StatsConfig `yaml:"stats,omitempty" json:"stats"`
+	// Alerts notify someone when services crash, turn unhealthy or use too much.
+	Alerts *AlertConfig `yaml:"alerts,omitempty" json:"alerts"`
 
 	MetaVars map[string]string `yaml:"meta-variables" json:"metaVars"`
 }
@@ -78,48 +121,175 @@ type Service struct {
 	Env  []string `yaml:"env" json:"env"`
 	Args []string `yaml:"args" json:"args"`
 
+	// Replicas runs that many copies of the service, {{.Index}} and {{.Port}}
+	// (Port plus the index) are replaced in args, env, health checks and meta files.
+	Replicas int `yaml:"replicas,omitempty" json:"replicas"`
+	Port     int `yaml:"port,omitempty" json:"port"`
+
+	DependsOn []string `yaml:"depends-on,omitempty" json:"dependsOn"`
+
+	StopSignal  string        `yaml:"stop-signal,omitempty" json:"stopSignal"`
+	StopTimeout time.Duration `yaml:"stop-timeout,omitempty" json:"stopTimeout"`
+
+	Restart *RestartConfig `yaml:"restart,omitempty" json:"restart"`
+	Health  *HealthCheck   `yaml:"health,omitempty" json:"health"`
+	Deploy  *DeployConfig  `yaml:"deploy,omitempty" json:"deploy"`
+	Log     *LogConfig     `yaml:"log,omitempty" json:"log"`
+	Sinks   []*SinkConfig  `yaml:"sinks,omitempty" json:"sinks"`
+	Limits  *LimitsConfig  `yaml:"limits,omitempty" json:"limits"`
+
+	// runner and Running are guarded by lock
 	runner *Runner `yaml:"-" json:"-"`
+	index  int
+	// id is fixed once the replicas are expanded, so that it can be read while reloading
+	id string
+
+	lock         sync.Mutex
+	state        ServiceState
+	lastStop     StopResult
+	runs         RunHistory
+	restartCount int
+	stats        *SampleHistory
+	restarts     []time.Time
+	retry        *time.Timer
+}
+
+// Runner returns the runner of the current process of the service.
+func (s *Service) Runner() *Runner {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.runner
+}
+
+func (s *Service) setRunner(runner *Runner) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.runner = runner
+}
+
+func (s *Service) IsRunning() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Running
+}
+
+func (s *Service) setRunning(running bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Running = running
 }
 
 func (s *Service) MarshalJSON() ([]byte, error) {
-	s.runner.checkStat()
-	pid := 0
-	if s.runner.process != nil {
-		pid = int(s.runner.process.Pid)
-	}
+	runner := s.Runner()
+	usage := runner.Usage()
+	s.lock.Lock()
+	name, tag, configFile := s.Name, s.Tag, s.ConfigFile
+	s.lock.Unlock()
 	swp := ServiceWithProcess{
-		Name:    s.Name,
-		Tag:     s.Tag,
-		Exec:    s.Exec,
-		Running: s.Running,
-		Mem:     s.runner.mem,
-		CPU:     s.runner.cpu,
-		FDNum:   s.runner.fdNum,
-		PID:     pid,
+		ID:           s.ID(),
+		Replica:      s.index,
+		Name:         name,
+		Tag:          tag,
+		Exec:         s.Exec,
+		Running:      s.IsRunning(),
+		State:        s.State(),
+		Restarts:     s.RestartCount(),
+		LastExitCode: s.runs.LastExitCode(),
+		Health:       runner.Health(),
+		LastStop:     s.LastStop(),
+		Mem:          usage.Mem,
+		CPU:          usage.CPU,
+		FDNum:        usage.FDNum,
+		PID:          usage.PID,
 
-		ConfigFile: s.ConfigFile,
+		ConfigFile: configFile,
 
-		Connections: s.runner.connections,
-		Paths:       s.runner.paths,
+		Connections: usage.Connections,
+		Paths:       usage.Paths,
 	}
 	return json.Marshal(swp)
 }
 
 type ServiceWithProcess struct {
-	PID        int     `json:"pid"`
-	Tag        string  `json:"tag"`
-	Name       string  `json:"name"`
-	ConfigFile string  `json:"configFile"`
-	Exec       string  `json:"exec"`
-	Running    bool    `json:"running"`
-	Mem        int     `json:"mem"`
-	CPU        float64 `json:"cpu"`
-	FDNum      int     `json:"fdNum"`
+	ID           string       `json:"id"`
+	Replica      int          `json:"replica"`
+	PID          int          `json:"pid"`
+	Tag          string       `json:"tag"`
+	Name         string       `json:"name"`
+	ConfigFile   string       `json:"configFile"`
+	Exec         string       `json:"exec"`
+	Running      bool         `json:"running"`
+	State        ServiceState `json:"state"`
+	Restarts     int          `json:"restarts"`
+	LastExitCode *int         `json:"lastExitCode"`
+	Health       Health       `json:"health,omitempty"`
+	LastStop     StopResult   `json:"lastStop,omitempty"`
+	Mem          int          `json:"mem"`
+	CPU          float64      `json:"cpu"`
+	FDNum        int          `json:"fdNum"`
 
 	Connections []string `json:"connections"`
 	Paths       []string `json:"paths"`
 }
 
+func (s *Service) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Exec == "" {
+		return fmt.Errorf("exec is required")
+	}
+	if s.Replicas < 0 || s.Port < 0 {
+		return fmt.Errorf("replicas and port must not be negative")
+	}
+	if policy := s.Restart.policy(); policy != RestartNever && policy != RestartOnFailure && policy != RestartAlways {
+		return fmt.Errorf("unknown restart policy %q", policy)
+	}
+	if _, err := ParseStopSignal(s.StopSignal); err != nil {
+		return err
+	}
+	for _, sink := range s.Sinks {
+		if err := sink.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := s.Limits.Validate(); err != nil {
+		return err
+	}
+	if s.Health != nil {
+		probes := lo.Compact([]bool{s.Health.HTTP != "", s.Health.TCP != "", len(s.Health.Exec) > 0})
+		if len(probes) != 1 {
+			return fmt.Errorf("health check needs exactly one of http, tcp or exec")
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateServices() error {
+	for _, sink := range c.Sinks {
+		if err := sink.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Alerts.Validate(); err != nil {
+		return fmt.Errorf("alerts: %w", err)
+	}
+	if err := c.Stats.Validate(); err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	execs := map[string]bool{}
+	for _, s := range c.Services {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("service %s: %w", s.Exec, err)
+		}
+		if execs[s.Exec] {
+			return fmt.Errorf("service %s: duplicated exec", s.Exec)
+		}
+		execs[s.Exec] = true
+	}
+	return nil
+}
+
 func (s *Service) Packed() bool {
 	return s.Folder != ""
 }
@@ -147,17 +317,9 @@ func GenerateDefault() *Config {
 	return &Config{
 		Name:     "deploy",
 		MetaVars: map[string]string{},
-		Accounts: []*BasicAuth{{Username: "admin", Password: "admin"}},
+		Accounts: []*BasicAuth{{Username: "admin", Password: "admin", Role: RoleAdmin}},
 		Port:     7798,
 		Services: []*Service{&s},
 		Mode:     Staging,
 	}
 }
-
-func (c Config) AccountMap() map[string]string {
-	m := make(map[string]string)
-	for _, a := range c.Accounts {
-		m[a.Username] = a.Password
-	}
-	return m
-}
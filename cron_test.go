@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"@every",
+	}
+	for _, expr := range tests {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	// 2024-01-01 is a monday
+	tests := []struct {
+		expr string
+		time time.Time
+		want bool
+	}{
+		{"* * * * *", date(2024, 1, 1, 13, 37), true},
+		{"30 * * * *", date(2024, 1, 1, 13, 30), true},
+		{"30 * * * *", date(2024, 1, 1, 13, 31), false},
+		// lists and ranges
+		{"0,15,45 * * * *", date(2024, 1, 1, 0, 15), true},
+		{"0,15,45 * * * *", date(2024, 1, 1, 0, 30), false},
+		{"0 9-17 * * *", date(2024, 1, 1, 17, 0), true},
+		{"0 9-17 * * *", date(2024, 1, 1, 18, 0), false},
+		{"0 1-3,22 * * *", date(2024, 1, 1, 22, 0), true},
+		// steps
+		{"*/15 * * * *", date(2024, 1, 1, 0, 45), true},
+		{"*/15 * * * *", date(2024, 1, 1, 0, 50), false},
+		{"10-30/10 * * * *", date(2024, 1, 1, 0, 20), true},
+		{"10-30/10 * * * *", date(2024, 1, 1, 0, 40), false},
+		{"5/20 * * * *", date(2024, 1, 1, 0, 45), true},
+		{"5/20 * * * *", date(2024, 1, 1, 0, 5), true},
+		{"5/20 * * * *", date(2024, 1, 1, 0, 0), false},
+		// 0 and 7 are both sunday
+		{"0 0 * * 0", date(2024, 1, 7, 0, 0), true},
+		{"0 0 * * 7", date(2024, 1, 7, 0, 0), true},
+		{"0 0 * * 5-7", date(2024, 1, 7, 0, 0), true},
+		{"0 0 * * 7", date(2024, 1, 8, 0, 0), false},
+		// with both days restricted either of them matches
+		{"0 0 13 * 5", date(2024, 1, 13, 0, 0), true},
+		{"0 0 13 * 5", date(2024, 1, 5, 0, 0), true},
+		{"0 0 13 * 5", date(2024, 1, 6, 0, 0), false},
+		// with one of them unrestricted, both must match
+		{"0 0 13 * *", date(2024, 1, 5, 0, 0), false},
+		{"0 0 * * 5", date(2024, 1, 13, 0, 0), false},
+		{"0 0 */2 * 1", date(2024, 1, 1, 0, 0), true},
+		{"0 0 */2 * 1", date(2024, 1, 3, 0, 0), false},
+		{"0 0 */2 * 1", date(2024, 1, 8, 0, 0), false},
+		{"0 0 1 * */2", date(2024, 1, 1, 0, 0), false},
+		{"0 0 2 * */2", date(2024, 1, 2, 0, 0), true},
+		// months and descriptors
+		{"0 0 1 1,7 *", date(2024, 7, 1, 0, 0), true},
+		{"0 0 1 1,7 *", date(2024, 6, 1, 0, 0), false},
+		{"@weekly", date(2024, 1, 7, 0, 0), true},
+		{"@weekly", date(2024, 1, 8, 0, 0), false},
+		{"@hourly", date(2024, 1, 8, 5, 0), true},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Matches(tt.time); got != tt.want {
+			t.Errorf("%q Matches(%s) = %v, want %v", tt.expr, tt.time.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", date(2024, 1, 1, 13, 37), date(2024, 1, 1, 13, 38)},
+		{"30 * * * *", date(2024, 1, 1, 13, 30), date(2024, 1, 1, 14, 30)},
+		{"*/15 * * * *", date(2024, 1, 1, 13, 46), date(2024, 1, 1, 14, 0)},
+		{"0 9 * * *", date(2024, 1, 1, 10, 0), date(2024, 1, 2, 9, 0)},
+		// rolls over the month and the year
+		{"0 0 1 * *", date(2024, 1, 15, 0, 0), date(2024, 2, 1, 0, 0)},
+		{"0 0 31 * *", date(2024, 1, 31, 12, 0), date(2024, 3, 31, 0, 0)},
+		{"0 0 29 2 *", date(2024, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		{"@yearly", date(2024, 12, 31, 23, 59), date(2025, 1, 1, 0, 0)},
+		{"59 23 31 12 *", date(2024, 12, 31, 23, 58), date(2024, 12, 31, 23, 59)},
+		// the next sunday, written as 7
+		{"0 12 * * 7", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 12, 0)},
+		// either day matches
+		{"0 0 13 * 5", date(2024, 1, 6, 0, 0), date(2024, 1, 12, 0, 0)},
+		// never fires
+		{"0 0 30 2 *", date(2024, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q Next(%s) = %s, want %s", tt.expr, tt.from.Format(time.RFC1123), got.Format(time.RFC1123), tt.want.Format(time.RFC1123))
+		}
+	}
+}
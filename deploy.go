@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// DeployConfig enables safe deploys: the new release is only kept once the
+// replicas started with it are ready, otherwise the previous version is put back.
+type DeployConfig struct {
+	Safe    bool          `yaml:"safe" json:"safe"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+func (c *DeployConfig) safe() bool {
+	return c != nil && c.Safe
+}
+
+func (c *DeployConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 30 * time.Second
+}
+
+// liveRelease is the executable or folder the replicas of the service run.
+func liveRelease(service *Service) string {
+	if service.Packed() {
+		return service.ServiceFolder()
+	}
+	return service.ExecPath()
+}
+
+// swapIn puts the staged release in place, keeping the live one aside, and
+// returns where the live one was kept, or "" when there was none.
+func swapIn(service *Service, staged string) (string, error) {
+	live := liveRelease(service)
+	previous := live + ".old"
+	os.RemoveAll(previous)
+	if err := os.Rename(live, previous); os.IsNotExist(err) {
+		previous = ""
+	} else if err != nil {
+		return "", err
+	}
+	if err := os.Rename(staged, live); err != nil {
+		if previous != "" {
+			os.Rename(previous, live)
+		}
+		return "", err
+	}
+	return previous, nil
+}
+
+// restore puts back the release kept aside by swapIn.
+func restore(service *Service, previous string) error {
+	live := liveRelease(service)
+	if err := os.RemoveAll(live); err != nil {
+		return err
+	}
+	if previous == "" {
+		return nil
+	}
+	return os.Rename(previous, live)
+}
+
+// SafeDeploy stops the running replicas, puts the release in place and starts
+// them again, waiting for every one of them to be ready. If any of them never
+// gets ready, the previous version is put back and the replicas are restarted
+// with it. Stopped replicas are left alone.
+func (e *Engine) SafeDeploy(service *Service, release *Release) error {
+	staged, err := release.Stage(service)
+	if err != nil {
+		return err
+	}
+	running := lo.Filter(e.GetReplicas(service.Exec), func(s *Service, i int) bool { return s.IsRunning() })
+	for _, replica := range running {
+		if err := e.StopService(replica.ID()); err != nil {
+			fmt.Println("failed to stop service", replica.ID(), err)
+		}
+	}
+
+	previous, err := swapIn(service, staged)
+	if err == nil {
+		err = e.startReady(running, service.Deploy.timeout())
+		if err == nil {
+			os.RemoveAll(previous)
+			return releases.SetCurrent(service, release.ID)
+		}
+		err = fmt.Errorf("release %d failed readiness check, rolled back to the previous version: %w", release.ID, err)
+		for _, replica := range running {
+			if err := e.StopService(replica.ID()); err != nil {
+				fmt.Println("failed to stop service", replica.ID(), err)
+			}
+		}
+		if restoreErr := restore(service, previous); restoreErr != nil {
+			err = fmt.Errorf("%w, and the previous version could not be put back: %s", err, restoreErr)
+		}
+	} else {
+		os.RemoveAll(staged)
+	}
+	for _, replica := range running {
+		if err := e.StartService(replica.ID()); err != nil {
+			fmt.Println("failed to start service", replica.ID(), err)
+		}
+	}
+	return err
+}
+
+// startReady starts the replicas and waits for all of them to be ready.
+func (e *Engine) startReady(replicas []*Service, timeout time.Duration) error {
+	for _, replica := range replicas {
+		if err := e.StartService(replica.ID()); err != nil {
+			return fmt.Errorf("%s: %w", replica.ID(), err)
+		}
+	}
+	for _, replica := range replicas {
+		if err := replica.Runner().waitReady(timeout); err != nil {
+			return fmt.Errorf("%s: %w", replica.ID(), err)
+		}
+	}
+	return nil
+}
+
+// waitReady waits until the health check passes, or, without a health check,
+// until the process has stayed up for the whole timeout.
+func (r *Runner) waitReady(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.exited:
+			return fmt.Errorf("process exited")
+		case <-deadline:
+			if r.healthCheck == nil {
+				return nil
+			}
+			return fmt.Errorf("not healthy after %s", timeout)
+		case <-ticker.C:
+			switch r.Health() {
+			case HealthHealthy:
+				return nil
+			case HealthUnhealthy:
+				return fmt.Errorf("unhealthy")
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/lo"
+)
+
+// DependencyTimeout is how long a service waits for its dependencies to get ready.
+var DependencyTimeout = time.Minute
+
+// sortServices orders services so that each comes after its dependencies,
+// otherwise keeping the config order. Dependencies outside the list are ignored.
+func sortServices(services []*Service) ([]*Service, error) {
+	byExec := lo.GroupBy(services, func(s *Service) string { return s.Exec })
+	sorted := []*Service{}
+	done := map[string]bool{}
+	visiting := []string{}
+
+	var visit func(s *Service) error
+	visit = func(s *Service) error {
+		if done[s.ID()] {
+			return nil
+		}
+		if lo.Contains(visiting, s.ID()) {
+			cycle := append(visiting[lo.IndexOf(visiting, s.ID()):], s.ID())
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+		visiting = append(visiting, s.ID())
+		for _, dep := range s.DependsOn {
+			for _, d := range byExec[dep] {
+				if err := visit(d); err != nil {
+					return err
+				}
+			}
+		}
+		visiting = visiting[:len(visiting)-1]
+		done[s.ID()] = true
+		sorted = append(sorted, s)
+		return nil
+	}
+
+	for _, s := range services {
+		if err := visit(s); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+func (c *Config) validateDependencies() error {
+	execs := lo.Map(c.Services, func(s *Service, i int) string { return s.Exec })
+	for _, s := range c.Services {
+		for _, dep := range s.DependsOn {
+			if !lo.Contains(execs, dep) {
+				return fmt.Errorf("service %s: unknown dependency %s", s.Exec, dep)
+			}
+		}
+	}
+	_, err := sortServices(c.Services)
+	return err
+}
+
+// WaitReady waits until the service is running and, if it has a health check, healthy.
+func (s *Service) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		switch state := s.State(); state {
+		case StateRunning:
+			return nil
+		case StateUnhealthy, StateCrashLooping, StateExited:
+			return fmt.Errorf("service %s is %s", s.ID(), state)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("service %s not ready after %s", s.ID(), timeout)
+}
+
+// StartAll starts the services in dependency order, waiting for the
+// dependencies of each service to get ready first.
+func (e *Engine) StartAll(services []*Service) []error {
+	sorted, err := sortServices(services)
+	if err != nil {
+		return []error{err}
+	}
+	errs := []error{}
+	for _, s := range sorted {
+		for _, dep := range s.DependsOn {
+			for _, d := range e.GetReplicas(dep) {
+				if err := d.WaitReady(DependencyTimeout); err != nil {
+					fmt.Println("starting", s.ID(), "anyway:", err)
+				}
+			}
+		}
+		if err := e.StartService(s.ID()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.ID(), err))
+		}
+	}
+	return errs
+}
+
+// StopAll stops the services in reverse dependency order.
+func (e *Engine) StopAll(services []*Service) []error {
+	sorted, err := sortServices(services)
+	if err != nil {
+		return []error{err}
+	}
+	errs := []error{}
+	for _, s := range lo.Reverse(sorted) {
+		if err := e.StopService(s.ID()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.ID(), err))
+		}
+	}
+	return errs
+}
+
+func (e *Engine) GetGroup(tag string) []*Service {
+	return lo.Filter(e.Services(), func(s *Service, i int) bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.Tag == tag
+	})
+}
+
+func GroupHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		engine := GetEngine(r)
+		config := GetConfig(r)
+		user := GetUser(r)
+		tag := chi.URLParam(r, "tag")
+		services := engine.GetGroup(tag)
+		if len(services) == 0 {
+			render.JSON(w, r, NewError(ErrServiceNotFound))
+			return
+		}
+		for _, s := range services {
+			if !config.RoleOf(user, s.Exec).Allows(RoleOperator) {
+				render.Status(r, http.StatusForbidden)
+				render.JSON(w, r, NewError(ErrForbidden))
+				return
+			}
+		}
+
+		errs := []error{}
+		switch action {
+		case "start":
+			errs = engine.StartAll(services)
+		case "stop":
+			errs = engine.StopAll(services)
+		case "restart":
+			errs = append(engine.StopAll(services), engine.StartAll(services)...)
+		}
+		var err error
+		if len(errs) > 0 {
+			err = fmt.Errorf("%s", strings.Join(lo.Map(errs, func(err error, i int) string { return err.Error() }), "; "))
+		}
+		Audit(r, "group-"+action, tag, err)
+		if err != nil {
+			render.JSON(w, r, NewError(err))
+			return
+		}
+		render.JSON(w, r, NewData(lo.Map(services, func(s *Service, i int) string { return s.ID() })))
+	}
+}
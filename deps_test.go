@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func depService(exec string, deps ...string) *Service {
+	return &Service{Exec: exec, DependsOn: deps}
+}
+
+func TestSortServices(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []*Service
+		want     []string
+	}{
+		{"no dependencies keep the config order",
+			[]*Service{depService("a"), depService("b"), depService("c")},
+			[]string{"a", "b", "c"}},
+		{"dependencies come first",
+			[]*Service{depService("web", "api"), depService("api", "db"), depService("db")},
+			[]string{"db", "api", "web"}},
+		{"shared dependency",
+			[]*Service{depService("a", "db"), depService("b", "db"), depService("db")},
+			[]string{"db", "a", "b"}},
+		{"dependencies outside the list are ignored",
+			[]*Service{depService("web", "api")},
+			[]string{"web"}},
+		{"every replica of a dependency",
+			[]*Service{depService("web", "api"), {Exec: "api", index: 0, Replicas: 2}, {Exec: "api", index: 1, Replicas: 2}},
+			[]string{"api@0", "api@1", "web"}},
+	}
+	for _, tt := range tests {
+		sorted, err := sortServices(tt.services)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := lo.Map(sorted, func(s *Service, i int) string { return s.ID() })
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: order %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortServicesCycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []*Service
+		cycle    string
+	}{
+		{"self", []*Service{depService("a", "a")}, "a -> a"},
+		{"pair", []*Service{depService("a", "b"), depService("b", "a")}, "a -> b -> a"},
+		{"behind a valid service",
+			[]*Service{depService("web", "api"), depService("api", "db"), depService("db", "api")},
+			"api -> db -> api"},
+	}
+	for _, tt := range tests {
+		_, err := sortServices(tt.services)
+		if err == nil {
+			t.Errorf("%s: cycle not detected", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.cycle) {
+			t.Errorf("%s: error %q does not show the cycle %s", tt.name, err, tt.cycle)
+		}
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	config := &Config{Services: []*Service{depService("web", "api"), depService("api")}}
+	if err := config.validateDependencies(); err != nil {
+		t.Errorf("valid dependencies rejected: %v", err)
+	}
+	config = &Config{Services: []*Service{depService("web", "cache")}}
+	if err := config.validateDependencies(); err == nil {
+		t.Error("unknown dependency accepted")
+	}
+	config = &Config{Services: []*Service{depService("a", "b"), depService("b", "a")}}
+	if err := config.validateDependencies(); err == nil {
+		t.Error("dependency cycle accepted")
+	}
+}
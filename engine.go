@@ -10,86 +10,112 @@ import (
 
 type Engine struct {
 	services []*Service
+	jobs     []*Job
 	meta     map[string]string
 
 	lock sync.Mutex
 	mode Mode
+	// servicesLock guards the services slice, which is replaced and never
+	// modified in place, so that it can be read without waiting for lock.
+	servicesLock sync.RWMutex
 }
 
 var ErrServiceNotFound = fmt.Errorf("service not found")
 var ErrServiceConfigNotFound = fmt.Errorf("service config not found")
 
+// Init starts the services in dependency order, returning once every one of
+// them has been started.
 func (e *Engine) Init(mode Mode, services []*Service, meta map[string]string) {
-	for _, s := range services {
-		runner := NewRunner(s, mode, meta)
-		runner.Start()
-		s.runner = runner
-	}
 	e.meta = meta
 	e.mode = mode
-	e.services = services
+	e.setServices(services)
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		e.lock.Lock()
-		wg := sync.WaitGroup{}
-		wg.Add(len(e.services))
-		for _, s := range e.services {
-			go func(s *Service) {
-				s.runner.Stop()
-				wg.Done()
-			}(s)
-		}
-		wg.Wait()
-
-		e.lock.Unlock()
+		e.StopJobs()
+		e.StopAll(e.Services())
+		sinks.Close()
 		os.Exit(0)
 	}()
+
+	for _, err := range e.StartAll(services) {
+		fmt.Println("failed to start service", err)
+	}
+}
+
+// newRunner creates a runner for the service whose unexpected exits are
+// handed to the supervisor.
+func (e *Engine) newRunner(s *Service) *Runner {
+	runner := NewRunner(s, e.mode, e.meta)
+	runner.onExit = func(err error) { e.supervise(s, runner, err) }
+	runner.onUnhealthy = func() { go e.restartUnhealthy(s, runner) }
+	return runner
 }
 
-func (e *Engine) GetService(exec string) *Service {
-	for _, s := range e.services {
-		if s.Exec == exec {
+// Services returns the current services.
+func (e *Engine) Services() []*Service {
+	e.servicesLock.RLock()
+	defer e.servicesLock.RUnlock()
+	return e.services
+}
+
+func (e *Engine) setServices(services []*Service) {
+	e.servicesLock.Lock()
+	defer e.servicesLock.Unlock()
+	e.services = services
+}
+
+// GetService returns the service, or the replica, with the id.
+func (e *Engine) GetService(id string) *Service {
+	for _, s := range e.Services() {
+		if s.ID() == id {
 			return s
 		}
 	}
 	return nil
 }
 
-func (e *Engine) StartService(exec string) error {
-	service := e.GetService(exec)
+func (e *Engine) StartService(id string) error {
+	service := e.GetService(id)
 	if service == nil {
 		return ErrServiceNotFound
 	}
 	e.lock.Lock()
 	defer e.lock.Unlock()
 
-	if err := service.runner.Stop(); err != nil {
-		fmt.Println("failed to stop service", exec, err)
+	service.resetSupervision()
+	if err := service.Runner().Stop(); err != nil {
+		fmt.Println("failed to stop service", id, err)
 	}
 
-	service.runner = NewRunner(service, e.mode, e.meta)
-	return service.runner.Start()
+	runner := e.newRunner(service)
+	service.setRunner(runner)
+	return runner.Start()
 }
 
-func (e *Engine) StopService(exec string) error {
-	service := e.GetService(exec)
+func (e *Engine) StopService(id string) error {
+	service := e.GetService(id)
 	if service == nil {
 		return ErrServiceNotFound
 	}
 	e.lock.Lock()
 	defer e.lock.Unlock()
-	return service.runner.Stop()
+	service.resetSupervision()
+	return service.Runner().Stop()
 }
 
-func (e *Engine) Restart(exec string) error {
-	service := e.GetService(exec)
+func (e *Engine) Restart(id string) error {
+	service := e.GetService(id)
 	if service == nil {
 		return ErrServiceNotFound
 	}
-	service.runner.Stop()
-	service.runner = NewRunner(service, e.mode, e.meta)
-	return service.runner.Start()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	service.resetSupervision()
+	service.Runner().Stop()
+	runner := e.newRunner(service)
+	service.setRunner(runner)
+	return runner.Start()
 }
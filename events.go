@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+	"github.com/samber/lo"
+)
+
+var ErrUnknownTopic = fmt.Errorf("unknown topic")
+var ErrStreamingUnsupported = fmt.Errorf("streaming unsupported")
+
+type LifecycleStep string
+
+var (
+	LifecycleStarted      LifecycleStep = "started"
+	LifecycleStopped      LifecycleStep = "stopped"
+	LifecycleExited       LifecycleStep = "exited"
+	LifecycleCrashed      LifecycleStep = "crashed"
+	LifecycleRestarting   LifecycleStep = "restarting"
+	LifecycleCrashLooping LifecycleStep = "crash-looping"
+	LifecycleHealthy      LifecycleStep = "healthy"
+	LifecycleUnhealthy    LifecycleStep = "unhealthy"
+	LifecycleUploaded     LifecycleStep = "uploaded"
+	LifecycleUploadFailed LifecycleStep = "upload-failed"
+	LifecycleDeployed     LifecycleStep = "deployed"
+)
+
+// LifecycleEvent is published on lifecycle/<id> when a service or a job changes state.
+type LifecycleEvent struct {
+	Service string        `json:"service"`
+	Step    LifecycleStep `json:"step"`
+	Run     int           `json:"run,omitempty"`
+	PID     int           `json:"pid,omitempty"`
+	Message string        `json:"message,omitempty"`
+}
+
+func publishLifecycle(event LifecycleEvent) {
+	hub.Publish(Topic(TopicLifecycle, event.Service), event)
+}
+
+// lifecycle publishes a step of the current run of the runner.
+func (r *Runner) lifecycle(step LifecycleStep, message string) {
+	event := LifecycleEvent{Service: r.exec, Step: step, Message: message}
+	if r.run != nil {
+		event.Run = r.run.ID
+		event.PID = r.run.PID
+	}
+	publishLifecycle(event)
+}
+
+// parseTopics validates a comma separated list of topics.
+func parseTopics(value string) ([]string, error) {
+	topics := lo.Filter(strings.Split(value, ","), func(topic string, i int) bool { return topic != "" })
+	for _, topic := range topics {
+		if kind, _ := splitTopic(topic); !lo.Contains(topicKinds, kind) {
+			return nil, fmt.Errorf("%s: %w", topic, ErrUnknownTopic)
+		}
+	}
+	return topics, nil
+}
+
+// topicAllowed lets viewers of a service get its topics, and global viewers the rollouts.
+func topicAllowed(config *Config, user string) func(topic string) bool {
+	return func(topic string) bool {
+		kind, key := splitTopic(topic)
+		if kind == TopicRollout {
+			return config.RoleOf(user, "").Allows(RoleViewer)
+		}
+		exec, _ := splitID(key)
+		return config.RoleOf(user, exec).Allows(RoleViewer)
+	}
+}
+
+// EventsMessage changes the topics of a websocket client.
+type EventsMessage struct {
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+// EventsHandler streams the events of the topics in ?topics= over a websocket,
+// or as server-sent events when the request is not a websocket upgrade. Output
+// events are filtered with the output options. The events of the services the
+// user cannot view are left out.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	options, err := ParseOutputOptions(r)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	topics, err := parseTopics(r.URL.Query().Get("topics"))
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	allow := topicAllowed(GetConfig(r), GetUser(r))
+	if websocket.IsWebSocketUpgrade(r) {
+		serveEventsWebsocket(w, r, topics, options, allow)
+		return
+	}
+	serveEventsSSE(w, r, topics, options, allow)
+}
+
+func serveEventsWebsocket(w http.ResponseWriter, r *http.Request, topics []string, options *OutputOptions, allow func(string) bool) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	client := wsClient(conn, options)
+	client.allow = allow
+	defer hub.Leave(client)
+	defer conn.Close()
+	hub.Subscribe(client, topics...)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := EventsMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			fmt.Println("invalid events message:", err)
+			continue
+		}
+		subscribe, err := parseTopics(strings.Join(msg.Subscribe, ","))
+		if err != nil {
+			fmt.Println("invalid events message:", err)
+			continue
+		}
+		if len(msg.Unsubscribe) > 0 {
+			hub.Unsubscribe(client, msg.Unsubscribe...)
+		}
+		if len(subscribe) > 0 {
+			hub.Subscribe(client, subscribe...)
+		}
+	}
+}
+
+func serveEventsSSE(w http.ResponseWriter, r *http.Request, topics []string, options *OutputOptions, allow func(string) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.JSON(w, r, NewError(ErrStreamingUnsupported))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	client := NewClient(func(kind string, data []byte) error {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, cancel, options)
+	client.allow = allow
+	hub.Subscribe(client, topics...)
+	<-ctx.Done()
+	hub.Leave(client)
+	// the response must not be written once the handler returns
+	<-client.done
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type Health string
+
+var (
+	HealthStarting  Health = "starting"
+	HealthHealthy   Health = "healthy"
+	HealthUnhealthy Health = "unhealthy"
+)
+
+// HealthCheck probes a running service, exactly one of HTTP, TCP or Exec is used.
+type HealthCheck struct {
+	HTTP   string   `yaml:"http" json:"http"`
+	Status int      `yaml:"status" json:"status"`
+	TCP    string   `yaml:"tcp" json:"tcp"`
+	Exec   []string `yaml:"exec" json:"exec"`
+
+	Interval    time.Duration `yaml:"interval" json:"interval"`
+	Timeout     time.Duration `yaml:"timeout" json:"timeout"`
+	StartPeriod time.Duration `yaml:"start-period" json:"startPeriod"`
+	Threshold   int           `yaml:"failure-threshold" json:"failureThreshold"`
+	// Restart restarts the service once it turns unhealthy.
+	Restart bool `yaml:"restart" json:"restart"`
+}
+
+func (c *HealthCheck) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return 10 * time.Second
+}
+
+func (c *HealthCheck) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 2 * time.Second
+}
+
+func (c *HealthCheck) threshold() int {
+	if c.Threshold > 0 {
+		return c.Threshold
+	}
+	return 3
+}
+
+func (c *HealthCheck) probe(dir string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	switch {
+	case c.HTTP != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		status := c.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if resp.StatusCode != status {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	case c.TCP != "":
+		addr := c.TCP
+		if !strings.Contains(addr, ":") {
+			addr = "127.0.0.1:" + addr
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case len(c.Exec) > 0:
+		cmd := exec.CommandContext(ctx, c.Exec[0], c.Exec[1:]...)
+		cmd.Dir = dir
+		cmd.Env = env
+		return cmd.Run()
+	}
+	return nil
+}
+
+func (r *Runner) Health() Health {
+	if r == nil {
+		return ""
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.health
+}
+
+func (r *Runner) setHealth(health Health) {
+	r.lock.Lock()
+	changed := r.health != health
+	r.health = health
+	r.lock.Unlock()
+	if !changed {
+		return
+	}
+	switch health {
+	case HealthHealthy:
+		r.lifecycle(LifecycleHealthy, "")
+	case HealthUnhealthy:
+		r.lifecycle(LifecycleUnhealthy, "")
+	}
+}
+
+// watchHealth probes the process until it exits.
+func (r *Runner) watchHealth() {
+	check := r.healthCheck
+	started := time.Now()
+	failures := 0
+
+	ticker := time.NewTicker(check.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.exited:
+			return
+		case <-ticker.C:
+		}
+
+		err := check.probe(r.cmd.Dir, r.cmd.Env)
+		if err == nil {
+			failures = 0
+			r.setHealth(HealthHealthy)
+			continue
+		}
+		if r.Health() == HealthStarting && time.Since(started) < check.StartPeriod {
+			continue
+		}
+		failures++
+		fmt.Println(r.exec, "health check failed:", err)
+		if failures < check.threshold() {
+			continue
+		}
+		if r.Health() != HealthUnhealthy {
+			alerts.Fire(r.exec, AlertUnhealthy, err.Error())
+		}
+		r.setHealth(HealthUnhealthy)
+		if check.Restart && r.onUnhealthy != nil {
+			r.onUnhealthy()
+			return
+		}
+	}
+}
+
+func (e *Engine) restartUnhealthy(s *Service, unhealthy *Runner) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if s.Runner() != unhealthy {
+		return
+	}
+	fmt.Println(s.ID(), "is unhealthy, restarting")
+	if err := unhealthy.Stop(); err != nil {
+		fmt.Println("failed to stop service", s.ID(), err)
+	}
+	s.countRestart()
+	runner := e.newRunner(s)
+	s.setRunner(runner)
+	if err := runner.Start(); err != nil {
+		fmt.Println("failed to restart service", s.ID(), err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/lo"
+)
+
+// ExitTimeout is the exit reason of a job run stopped for going over its timeout.
+const ExitTimeout = "timeout"
+
+var ErrJobNotFound = fmt.Errorf("job not found")
+var ErrJobRunning = fmt.Errorf("job is already running")
+
+// OverlapPolicy decides what happens when a job is due while it is still running.
+type OverlapPolicy string
+
+var (
+	OverlapSkip  OverlapPolicy = "skip"
+	OverlapQueue OverlapPolicy = "queue"
+	OverlapAllow OverlapPolicy = "allow"
+)
+
+// Job is a command run on a cron schedule. It is defined like a service and
+// runs with the same runner, so it gets the same working dir, env, meta-vars and logs.
+type Job struct {
+	Service `yaml:",inline"`
+
+	Schedule string        `yaml:"schedule"`
+	Overlap  OverlapPolicy `yaml:"overlap,omitempty"`
+	// Timeout stops a run that takes longer, no timeout by default.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	schedule   *Schedule
+	activeLock sync.Mutex
+	active     []*Runner
+	queued     int
+}
+
+func (j *Job) overlap() OverlapPolicy {
+	if j.Overlap == "" {
+		return OverlapSkip
+	}
+	return j.Overlap
+}
+
+func (j *Job) Validate() error {
+	if err := j.Service.Validate(); err != nil {
+		return err
+	}
+	if j.replicated() {
+		return fmt.Errorf("jobs cannot have replicas")
+	}
+	if policy := j.overlap(); policy != OverlapSkip && policy != OverlapQueue && policy != OverlapAllow {
+		return fmt.Errorf("unknown overlap policy %q", policy)
+	}
+	schedule, err := ParseSchedule(j.Schedule)
+	if err != nil {
+		return err
+	}
+	j.schedule = schedule
+	return nil
+}
+
+func (c *Config) validateJobs() error {
+	execs := lo.SliceToMap(c.Services, func(s *Service) (string, bool) { return s.Exec, true })
+	for _, j := range c.Jobs {
+		if err := j.Validate(); err != nil {
+			return fmt.Errorf("job %s: %w", j.Exec, err)
+		}
+		if execs[j.Exec] {
+			return fmt.Errorf("job %s: duplicated exec", j.Exec)
+		}
+		execs[j.Exec] = true
+	}
+	return nil
+}
+
+type JobView struct {
+	Name         string        `json:"name"`
+	Tag          string        `json:"tag"`
+	Exec         string        `json:"exec"`
+	Schedule     string        `json:"schedule"`
+	Overlap      OverlapPolicy `json:"overlap"`
+	Timeout      time.Duration `json:"timeout"`
+	Running      int           `json:"running"`
+	Queued       int           `json:"queued"`
+	Next         time.Time     `json:"next"`
+	LastExitCode *int          `json:"lastExitCode"`
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.activeLock.Lock()
+	running, queued := len(j.active), j.queued
+	j.activeLock.Unlock()
+	view := JobView{
+		Name:         j.Name,
+		Tag:          j.Tag,
+		Exec:         j.Exec,
+		Schedule:     j.Schedule,
+		Overlap:      j.overlap(),
+		Timeout:      j.Timeout,
+		Running:      running,
+		Queued:       queued,
+		LastExitCode: j.runs.LastExitCode(),
+	}
+	if j.schedule != nil {
+		view.Next = j.schedule.Next(time.Now())
+	}
+	return json.Marshal(view)
+}
+
+func (e *Engine) GetJob(exec string) *Job {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	job, _ := lo.Find(e.jobs, func(j *Job) bool { return j.Exec == exec })
+	return job
+}
+
+// SetJobs applies a new list of jobs, matched to the current ones by exec so
+// that their history and running processes are kept. The runs of the removed
+// jobs are stopped.
+func (e *Engine) SetJobs(jobs []*Job) []*Job {
+	e.lock.Lock()
+	merged := []*Job{}
+	for _, n := range jobs {
+		j, ok := lo.Find(e.jobs, func(j *Job) bool { return j.Exec == n.Exec })
+		if !ok {
+			merged = append(merged, n)
+			continue
+		}
+		j.Service.update(&n.Service)
+		j.activeLock.Lock()
+		j.Schedule, j.Overlap, j.Timeout, j.schedule = n.Schedule, n.Overlap, n.Timeout, n.schedule
+		j.activeLock.Unlock()
+		merged = append(merged, j)
+	}
+	removed := lo.Without(e.jobs, merged...)
+	e.jobs = merged
+	e.lock.Unlock()
+
+	for _, j := range removed {
+		j.stop()
+	}
+	return merged
+}
+
+// RunJob starts a run of the job now, unless the overlap policy says otherwise.
+func (e *Engine) RunJob(j *Job) error {
+	j.activeLock.Lock()
+	defer j.activeLock.Unlock()
+	if len(j.active) > 0 {
+		switch j.overlap() {
+		case OverlapSkip:
+			return ErrJobRunning
+		case OverlapQueue:
+			j.queued++
+			return nil
+		}
+	}
+	runner := NewRunner(&j.Service, e.mode, e.meta)
+	if err := runner.Start(); err != nil {
+		return err
+	}
+	j.setRunner(runner)
+	j.active = append(j.active, runner)
+	go e.waitJob(j, runner)
+	return nil
+}
+
+// waitJob waits for a run to end, stopping it on timeout, and starts the
+// next queued run.
+func (e *Engine) waitJob(j *Job, runner *Runner) {
+	var timeout <-chan time.Time
+	if j.Timeout > 0 {
+		timer := time.NewTimer(j.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-runner.exited:
+	case <-timeout:
+		fmt.Println(j.Exec, "timed out after", j.Timeout)
+		if err := runner.Stop(); err != nil {
+			fmt.Println("failed to stop job", j.Exec, err)
+		}
+		runner.history.SetReason(runner.run, ExitTimeout)
+	}
+
+	j.activeLock.Lock()
+	j.active = lo.Without(j.active, runner)
+	next := j.queued > 0
+	if next {
+		j.queued--
+	}
+	j.activeLock.Unlock()
+	if next {
+		if err := e.RunJob(j); err != nil {
+			fmt.Println("failed to run job", j.Exec, err)
+		}
+	}
+}
+
+// StopJobs stops the running jobs, dropping the queued runs.
+func (e *Engine) StopJobs() {
+	e.lock.Lock()
+	jobs := e.jobs
+	e.lock.Unlock()
+	for _, j := range jobs {
+		j.stop()
+	}
+}
+
+// stop stops the runs of the job, dropping the queued ones.
+func (j *Job) stop() {
+	j.activeLock.Lock()
+	j.queued = 0
+	active := j.active
+	j.activeLock.Unlock()
+	for _, runner := range active {
+		if err := runner.Stop(); err != nil {
+			fmt.Println("failed to stop job", j.Exec, err)
+		}
+	}
+}
+
+// Schedule runs the due jobs at the start of every minute.
+func (e *Engine) Schedule() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+		e.lock.Lock()
+		jobs := e.jobs
+		e.lock.Unlock()
+		for _, j := range jobs {
+			j.activeLock.Lock()
+			due := j.schedule != nil && j.schedule.Matches(next)
+			j.activeLock.Unlock()
+			if !due {
+				continue
+			}
+			if err := e.RunJob(j); err != nil {
+				fmt.Println("failed to run job", j.Exec, err)
+			}
+		}
+	}
+}
+
+type jobKey struct{}
+
+// RequireJobMiddleware puts the job, and its service definition for the
+// handlers shared with services, into the context.
+func RequireJobMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job := GetEngine(r).GetJob(chi.URLParam(r, "job"))
+		if job == nil {
+			render.JSON(w, r, NewError(ErrJobNotFound))
+			return
+		}
+		ctx := context.WithValue(r.Context(), jobKey{}, job)
+		ctx = context.WithValue(ctx, serviceKey{}, &job.Service)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func GetJob(r *http.Request) *Job {
+	return r.Context().Value(jobKey{}).(*Job)
+}
+
+// VisibleJobs returns the jobs the user is allowed to view.
+func VisibleJobs(r *http.Request) []*Job {
+	config := GetConfig(r)
+	user := GetUser(r)
+	return lo.Filter(GetEngine(r).Jobs(), func(j *Job, i int) bool {
+		return config.RoleOf(user, j.Exec).Allows(RoleViewer)
+	})
+}
+
+func (e *Engine) Jobs() []*Job {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.jobs
+}
+
+func GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, NewData(GetJob(r)))
+}
+
+func RunJobHandler(w http.ResponseWriter, r *http.Request) {
+	engine := GetEngine(r)
+	job := GetJob(r)
+	err := engine.RunJob(job)
+	Audit(r, "run-job", "", err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(job))
+}
+
+// JobLogsHandler searches the logs of the job once it has run.
+func JobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	job := GetJob(r)
+	if job.Runner() == nil {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return
+	}
+	LogsHandler(w, r)
+}
@@ -6,7 +6,7 @@ import (
 
 func ProcAttr() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{
-		Setpgid:   false,
+		Setpgid:   true,
 		Pdeathsig: syscall.SIGKILL,
 	}
 }
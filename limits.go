@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExitOOMKilled is the exit reason of a process killed for going over its memory limit.
+const ExitOOMKilled = "oom-killed"
+
+var ErrOOMKilled = fmt.Errorf("killed for running out of memory")
+
+// LimitsConfig constrains the resources a service can use. On Linux memory,
+// cpu and pids are enforced by a cgroup v2 per service, falling back to rlimits
+// when cgroup v2 is not available.
+type LimitsConfig struct {
+	// Memory is the maximum memory, in bytes or with a K, M or G suffix.
+	Memory string `yaml:"memory,omitempty" json:"memory"`
+	// CPU is the number of cores the service may use, e.g. 0.5.
+	CPU       float64 `yaml:"cpu,omitempty" json:"cpu"`
+	Pids      int     `yaml:"pids,omitempty" json:"pids"`
+	OpenFiles uint64  `yaml:"open-files,omitempty" json:"openFiles"`
+}
+
+func (l *LimitsConfig) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if _, err := l.memory(); err != nil {
+		return err
+	}
+	if l.CPU < 0 || l.Pids < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// memory returns the memory limit in bytes, 0 means unlimited.
+func (l *LimitsConfig) memory() (int64, error) {
+	if l.Memory == "" {
+		return 0, nil
+	}
+	value := strings.TrimSuffix(strings.ToUpper(l.Memory), "B")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory limit %q", l.Memory)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+type cgroup struct{}
+
+func (l *LimitsConfig) apply(exec string, pid int) *cgroup {
+	if l != nil {
+		fmt.Println(exec, "resource limits are only supported on linux, ignored")
+	}
+	return nil
+}
+
+func (cg *cgroup) oomKilled() bool {
+	return false
+}
+
+func (cg *cgroup) remove() {}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CgroupRoot is the cgroup v2 directory under which each service gets its own cgroup.
+var CgroupRoot = "/sys/fs/cgroup/emu"
+
+func init() {
+	if root, ok := os.LookupEnv("EMU_CGROUP_ROOT"); ok && root != "" {
+		CgroupRoot = root
+	}
+}
+
+// cgroup is the cgroup v2 of a running service.
+type cgroup struct {
+	path string
+	ooms int
+}
+
+// apply puts the limits on the started process pid. The process is moved into
+// its cgroup right after it started, so whatever it does before that is not limited.
+func (l *LimitsConfig) apply(exec string, pid int) *cgroup {
+	if l == nil {
+		return nil
+	}
+	if l.OpenFiles > 0 {
+		limit := &unix.Rlimit{Cur: l.OpenFiles, Max: l.OpenFiles}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, limit, nil); err != nil {
+			fmt.Println(exec, "failed to limit open files", err)
+		}
+	}
+	if l.Memory == "" && l.CPU == 0 && l.Pids == 0 {
+		return nil
+	}
+	cg, err := newCgroup(exec, l)
+	if err == nil {
+		err = cg.add(pid)
+	}
+	if err == nil {
+		return cg
+	}
+	fmt.Println(exec, "cgroup v2 not available, falling back to rlimits:", err)
+	cg.remove()
+	l.setrlimit(exec, pid)
+	return nil
+}
+
+// setrlimit limits the address space. There is no rlimit for a cpu quota, and
+// RLIMIT_NPROC counts every process of the user rather than the service's.
+func (l *LimitsConfig) setrlimit(exec string, pid int) {
+	if memory, _ := l.memory(); memory > 0 {
+		limit := &unix.Rlimit{Cur: uint64(memory), Max: uint64(memory)}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, limit, nil); err != nil {
+			fmt.Println(exec, "failed to limit memory", err)
+		}
+	}
+	if l.Pids > 0 {
+		fmt.Println(exec, "pids limit needs cgroup v2, ignored")
+	}
+	if l.CPU > 0 {
+		fmt.Println(exec, "cpu limit needs cgroup v2, ignored")
+	}
+}
+
+func newCgroup(exec string, l *LimitsConfig) (*cgroup, error) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return nil, fmt.Errorf("/sys/fs/cgroup is not cgroup v2")
+	}
+	if err := os.MkdirAll(CgroupRoot, 0755); err != nil {
+		return nil, err
+	}
+	// controllers have to be enabled on every level down to the service's cgroup
+	controllers := "+memory +cpu +pids"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(CgroupRoot), "cgroup.subtree_control"), []byte(controllers), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(CgroupRoot, "cgroup.subtree_control"), []byte(controllers), 0644); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{path: filepath.Join(CgroupRoot, exec)}
+	if err := os.MkdirAll(cg.path, 0755); err != nil {
+		return nil, err
+	}
+
+	memory, _ := l.memory()
+	settings := map[string]string{"memory.max": "max", "cpu.max": "max", "pids.max": "max"}
+	if memory > 0 {
+		settings["memory.max"] = strconv.FormatInt(memory, 10)
+	}
+	if l.CPU > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d 100000", int(l.CPU*100000))
+	}
+	if l.Pids > 0 {
+		settings["pids.max"] = strconv.Itoa(l.Pids)
+	}
+	for file, value := range settings {
+		if err := os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0644); err != nil {
+			return cg, err
+		}
+	}
+	cg.ooms = cg.oomKills()
+	return cg, nil
+}
+
+func (cg *cgroup) add(pid int) error {
+	return os.WriteFile(filepath.Join(cg.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// oomKills reads the number of processes killed by the OOM killer in the cgroup.
+func (cg *cgroup) oomKills() int {
+	data, err := os.ReadFile(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "oom_kill ") {
+			n, _ := strconv.Atoi(strings.TrimPrefix(line, "oom_kill "))
+			return n
+		}
+	}
+	return 0
+}
+
+// oomKilled reports whether a process was OOM killed since the cgroup was set up.
+func (cg *cgroup) oomKilled() bool {
+	return cg != nil && cg.oomKills() > cg.ooms
+}
+
+// remove deletes the cgroup, which only works once all its processes are gone.
+func (cg *cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	os.Remove(cg.path)
+}
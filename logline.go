@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// MaxLineSize is the longest line kept in one record, longer lines are split.
+var MaxLineSize = 64 * 1024
+
+// LogRecord is one line of output of a service, timestamped when it was captured.
+// Lines that are JSON objects, as written by zap or logrus, get their level,
+// message and fields parsed.
+type LogRecord struct {
+	Time   time.Time              `json:"time"`
+	Stream Channel                `json:"stream"`
+	Line   string                 `json:"line"`
+	Level  string                 `json:"level,omitempty"`
+	Msg    string                 `json:"msg,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	// Run is the id of the run of the process that wrote the line.
+	Run int `json:"run,omitempty"`
+}
+
+func NewLogRecord(stream Channel, line string) LogRecord {
+	record := LogRecord{Time: time.Now(), Stream: stream, Line: line}
+	record.parseJSON()
+	return record
+}
+
+func (record *LogRecord) parseJSON() {
+	if !strings.HasPrefix(strings.TrimSpace(record.Line), "{") {
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(record.Line), &fields); err != nil {
+		return
+	}
+	for _, key := range []string{"level", "lvl", "severity"} {
+		if level, ok := fields[key].(string); ok {
+			record.Level = strings.ToLower(level)
+			delete(fields, key)
+			break
+		}
+	}
+	for _, key := range []string{"msg", "message"} {
+		if msg, ok := fields[key].(string); ok {
+			record.Msg = msg
+			delete(fields, key)
+			break
+		}
+	}
+	delete(fields, "ts")
+	delete(fields, "time")
+	if len(fields) > 0 {
+		record.Fields = fields
+	}
+}
+
+// Text is the record as shown in a terminal.
+func (record LogRecord) Text() []byte {
+	return []byte(record.Line + "\n")
+}
+
+// readLines calls emit with every line read from reader until it fails.
+func readLines(reader io.Reader, stream Channel, emit func(LogRecord)) error {
+	br := bufio.NewReaderSize(reader, MaxLineSize)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			emit(NewLogRecord(stream, strings.TrimRight(string(line), "\r\n")))
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
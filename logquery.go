@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+type LogQuery struct {
+	Pattern *regexp.Regexp
+	Level   string
+	Stream  Channel
+	Since   time.Time
+	Until   time.Time
+	Offset  int
+	Limit   int
+}
+
+func ParseLogQuery(r *http.Request) (*LogQuery, error) {
+	query := r.URL.Query()
+	q := &LogQuery{
+		Level:  strings.ToLower(query.Get("level")),
+		Stream: Channel(query.Get("stream")),
+		Limit:  100,
+	}
+	if q.Stream != "" && q.Stream != Stdout && q.Stream != Stderr {
+		return nil, fmt.Errorf("stream must be stdout or stderr")
+	}
+	if pattern := query.Get("q"); pattern != "" {
+		if query.Get("regex") != "true" {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		if query.Get("ignoreCase") == "true" {
+			pattern = "(?i)" + pattern
+		}
+		var err error
+		if q.Pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if since := query.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, err
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, err
+		}
+	}
+	if offset := query.Get("offset"); offset != "" {
+		if q.Offset, err = strconv.Atoi(offset); err != nil {
+			return nil, err
+		}
+		if q.Offset < 0 {
+			return nil, fmt.Errorf("offset must not be negative")
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, err
+		}
+		if q.Limit <= 0 {
+			return nil, fmt.Errorf("limit must be positive")
+		}
+	}
+	return q, nil
+}
+
+func (q *LogQuery) Match(record *LogRecord) bool {
+	if q.Level != "" && record.Level != q.Level {
+		return false
+	}
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && record.Time.After(q.Until) {
+		return false
+	}
+	return q.Pattern == nil || q.Pattern.MatchString(record.Line)
+}
+
+// recordReader reads the records of a list of log files one after the other,
+// gzip compressed backups included.
+type recordReader struct {
+	files  []string
+	name   string
+	file   *os.File
+	reader *bufio.Reader
+	stream Channel
+
+	record LogRecord
+	ok     bool
+}
+
+func newRecordReader(files []string, stream Channel) *recordReader {
+	reader := &recordReader{files: files, stream: stream}
+	reader.Next()
+	return reader
+}
+
+func (r *recordReader) open() bool {
+	for len(r.files) > 0 {
+		name := filepath.Join("log", r.files[0])
+		r.files = r.files[1:]
+		file, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		var reader io.Reader = file
+		if strings.HasSuffix(name, ".gz") {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				file.Close()
+				continue
+			}
+			reader = gz
+		}
+		r.name = name
+		r.file = file
+		r.reader = bufio.NewReaderSize(reader, 64*1024)
+		return true
+	}
+	return false
+}
+
+// maxRecordSize is the longest line of a log file read as a record, a record
+// of a MaxLineSize line with its JSON escaping fits.
+var maxRecordSize = 8 * MaxLineSize
+
+// readLine returns the next line of the file without its newline, skipping
+// the lines longer than maxRecordSize.
+func (r *recordReader) readLine() ([]byte, error) {
+	for {
+		line, tooLong := []byte{}, false
+		for {
+			chunk, err := r.reader.ReadSlice('\n')
+			if !tooLong && len(line)+len(chunk) <= maxRecordSize {
+				line = append(line, chunk...)
+			} else {
+				tooLong = true
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF && len(line) > 0 && !tooLong {
+				return bytes.TrimSuffix(line, []byte("\r")), nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		if !tooLong {
+			return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")), nil
+		}
+		fmt.Println("skipping a line longer than", maxRecordSize, "bytes in", r.name)
+	}
+}
+
+// Next moves to the next record, ok is false once every file has been read.
+func (r *recordReader) Next() {
+	for {
+		if r.reader == nil && !r.open() {
+			r.ok = false
+			return
+		}
+		line, err := r.readLine()
+		if err == nil {
+			r.record = LogRecord{}
+			if err := json.Unmarshal(line, &r.record); err != nil {
+				// lines written before output was captured as records
+				r.record = LogRecord{Stream: r.stream, Line: string(line)}
+			}
+			r.ok = true
+			return
+		}
+		if err != io.EOF {
+			fmt.Println("failed to read", r.name, err)
+		}
+		r.file.Close()
+		r.reader = nil
+	}
+}
+
+func (r *recordReader) Close() {
+	if r.reader != nil {
+		r.file.Close()
+	}
+}
+
+// Search streams the matching records of the runner's log files to emit,
+// merging stdout and stderr by time.
+func (q *LogQuery) Search(runner *Runner, emit func(LogRecord) error) error {
+	readers := []*recordReader{}
+	for _, stream := range []Channel{Stdout, Stderr} {
+		if q.Stream == "" || q.Stream == stream {
+			reader := newRecordReader(runner.logFiles(stream), stream)
+			defer reader.Close()
+			readers = append(readers, reader)
+		}
+	}
+
+	skipped, emitted := 0, 0
+	for emitted < q.Limit {
+		var next *recordReader
+		for _, reader := range readers {
+			if reader.ok && (next == nil || reader.record.Time.Before(next.record.Time)) {
+				next = reader
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		record := next.record
+		next.Next()
+		if !q.Match(&record) {
+			continue
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if err := emit(record); err != nil {
+			return err
+		}
+		emitted++
+	}
+	return nil
+}
+
+// LogsHandler streams the matching records as JSON lines, pass offset to get the next page.
+func LogsHandler(w http.ResponseWriter, r *http.Request) {
+	service := GetService(r)
+	query, err := ParseLogQuery(r)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	n := 0
+	err = query.Search(service.Runner(), func(record LogRecord) error {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		if n++; n%100 == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return r.Context().Err()
+	})
+	if err != nil {
+		fmt.Println("failed to search logs", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"stream=stdout&limit=10&offset=20", true},
+		{"stream=stderr", true},
+		{"stream=both", false},
+		{"limit=0", false},
+		{"limit=-1", false},
+		{"offset=-1", false},
+		{"q=(&regex=true", false},
+		{"since=yesterday", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseLogQuery(httptest.NewRequest("GET", "/logs?"+tt.query, nil))
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseLogQuery(%q) error = %v, want ok %v", tt.query, err, tt.ok)
+		}
+	}
+}
+
+func TestRecordReaderSkipsLongLines(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	os.Mkdir("log", 0755)
+
+	long := strings.Repeat("x", maxRecordSize+1)
+	lines := []string{`{"line":"first"}`, long, `{"line":"second"}`, "plain\r", `{"line":"last"}`}
+	if err := os.WriteFile(filepath.Join("log", "a.log"), []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	reader := newRecordReader([]string{"a.log"}, Stdout)
+	defer reader.Close()
+	for ; reader.ok; reader.Next() {
+		got = append(got, reader.record.Line)
+	}
+	want := []string{"first", "second", "plain", "last"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+}
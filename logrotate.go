@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LogConfig sets the rotation of a service's log files.
+type LogConfig struct {
+	// MaxSize is the size in megabytes a log file reaches before being rotated.
+	MaxSize    int `yaml:"max-size" json:"maxSize"`
+	MaxBackups int `yaml:"max-backups" json:"maxBackups"`
+	// MaxAge is the number of days rotated files are kept.
+	MaxAge    int  `yaml:"max-age" json:"maxAge"`
+	Compress  bool `yaml:"compress" json:"compress"`
+	LocalTime bool `yaml:"local-time" json:"localTime"`
+}
+
+func (c *LogConfig) Logger(filename string) *lumberjack.Logger {
+	logger := &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    100,
+		MaxBackups: 3,
+		MaxAge:     28,
+	}
+	if c == nil {
+		return logger
+	}
+	if c.MaxSize > 0 {
+		logger.MaxSize = c.MaxSize
+	}
+	if c.MaxBackups > 0 {
+		logger.MaxBackups = c.MaxBackups
+	}
+	if c.MaxAge > 0 {
+		logger.MaxAge = c.MaxAge
+	}
+	logger.Compress = c.Compress
+	logger.LocalTime = c.LocalTime
+	return logger
+}
+
+var rotatedLog = regexp.MustCompile(`-\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}\.\d{3}\.log(\.gz)?$`)
+
+// pruneLogs deletes the oldest rotated files in log/ until it uses at most maxSize megabytes.
+func pruneLogs(maxSize int) error {
+	entries, err := os.ReadDir("log")
+	if err != nil {
+		return err
+	}
+	var total int64
+	rotated := []os.FileInfo{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		total += info.Size()
+		if rotatedLog.MatchString(info.Name()) {
+			rotated = append(rotated, info)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].ModTime().Before(rotated[j].ModTime())
+	})
+
+	limit := int64(maxSize) * 1024 * 1024
+	for _, info := range rotated {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(filepath.Join("log", info.Name())); err != nil {
+			return err
+		}
+		fmt.Println("removed", info.Name(), "to keep log/ under", maxSize, "MB")
+		total -= info.Size()
+	}
+	return nil
+}
+
+// WatchLogDisk keeps log/ under the configured size.
+func WatchLogDisk(config func() *Config) {
+	for {
+		if maxSize := config().LogMaxTotalSize; maxSize > 0 {
+			if err := pruneLogs(maxSize); err != nil {
+				fmt.Println("failed to prune logs", err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -12,9 +12,9 @@ import (
 	"path"
 	"strconv"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
+	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
 )
 
@@ -39,6 +39,14 @@ func main() {
 	configPtr := flag.String("config", "config.yaml", "config file path")
 	flag.Parse()
 
+	if flag.Arg(0) == "passwd" {
+		if err := passwd(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if _, err := os.Stat(*configPtr); os.IsNotExist(err) {
 		// Create default config file
 		data, err := yaml.Marshal(GenerateDefault())
@@ -58,10 +66,22 @@ func main() {
 	}
 
 	go hub.Start()
+	sinks.Configure(config)
+	alerts.Configure(config)
 	engine := Engine{}
 	engine.Init(config.Mode, config.Services, config.MetaVars)
+	config.Jobs = engine.SetJobs(config.Jobs)
+	go engine.Schedule()
+	if config.Port == 0 {
+		config.Port = 8080
+	}
+	reloader := Reloader{path: *configPtr, config: config, engine: &engine}
+	go reloader.WatchSignal()
+	go WatchLogDisk(reloader.Config)
+	go engine.Sample(reloader.Config)
 
 	r := chi.NewRouter()
+	r.Use(metrics.Instrument)
 	// r.Use(middleware.DefaultLogger)
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		data, err := static.ReadFile("static/index.html")
@@ -82,25 +102,69 @@ func main() {
 	// fs := http.FileServer(http.Dir("./static/"))
 	r.Handle("/static/*", http.StripPrefix("/", fs))
 
+	r.Group(func(r chi.Router) {
+		r.Use(WithConfig(reloader.Config))
+		r.Use(Authenticate("letjoy"))
+		r.Use(WithEngine(&engine))
+		r.Get("/metrics", MetricsHandler)
+	})
+
 	r.Route("/api", func(r chi.Router) {
-		r.Use(middleware.BasicAuth("letjoy", config.AccountMap()))
-		r.Get("/config", func(w http.ResponseWriter, r *http.Request) {
-			render.JSON(w, r, NewData(config))
+		r.Use(WithConfig(reloader.Config))
+		r.Use(Authenticate("letjoy"))
+		r.Use(WithEngine(&engine))
+		r.With(RequireRole(RoleAdmin)).Get("/config", func(w http.ResponseWriter, r *http.Request) {
+			render.JSON(w, r, NewData(GetConfig(r)))
+		})
+		r.With(RequireRole(RoleAdmin)).Get("/audit", AuditHandler)
+		r.With(RequireRole(RoleAdmin)).Post("/reload", reloader.ReloadHandler)
+		r.Get("/events", EventsHandler)
+		r.Route("/group/{tag}", func(r chi.Router) {
+			r.Post("/start", GroupHandler("start"))
+			r.Post("/stop", GroupHandler("stop"))
+			r.Post("/restart", GroupHandler("restart"))
+		})
+		r.Route("/rollout", func(r chi.Router) {
+			r.Post("/", RolloutHandler)
+			r.With(RequireRole(RoleViewer)).Get("/{id}", GetRolloutHandler)
+			r.With(RequireRole(RoleViewer)).Get("/{id}/progress", RolloutProgressHandler)
+		})
+		r.Route("/tokens", func(r chi.Router) {
+			r.Get("/", ListTokensHandler)
+			r.Post("/", CreateTokenHandler)
+			r.Delete("/{id}", RevokeTokenHandler)
+		})
+		r.Route("/job", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				render.JSON(w, r, NewData(VisibleJobs(r)))
+			})
+			r.Route("/{job}", func(r chi.Router) {
+				r.Use(RequireJobMiddleware)
+				r.Use(RequireRole(RoleViewer))
+				r.Get("/", GetJobHandler)
+				r.Get("/runs", RunsHandler)
+				r.Get("/logs", JobLogsHandler)
+				r.Get("/output", GetOutputHandler)
+				r.With(RequireRole(RoleOperator)).Post("/run", RunJobHandler)
+			})
 		})
 		r.Route("/service", func(r chi.Router) {
 			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-				render.JSON(w, r, NewData(config.Services))
+				render.JSON(w, r, NewData(VisibleServices(r)))
 			})
+			r.With(RequireRole(RoleAdmin)).Post("/", reloader.CreateServiceHandler)
 
 			r.Route("/{service}", func(r chi.Router) {
-				r.Use(WithEngine(&engine))
 				r.Use(RequireServiceMiddleware)
-				r.Get("/clear", func(w http.ResponseWriter, r *http.Request) {
+				r.Use(RequireRole(RoleViewer))
+				r.With(RequireRole(RoleAdmin)).Put("/", reloader.UpdateServiceHandler)
+				r.With(RequireRole(RoleAdmin)).Delete("/", reloader.DeleteServiceHandler)
+				r.With(RequireRole(RoleOperator)).Get("/clear", func(w http.ResponseWriter, r *http.Request) {
 					err := clearHistory()
 					render.JSON(w, r, NewData(err))
 				})
 				r.Get("/config", GetConfigHandler)
-				r.Get("/config-file", func(w http.ResponseWriter, r *http.Request) {
+				r.With(RequireRole(RoleOperator)).Get("/config-file", func(w http.ResponseWriter, r *http.Request) {
 					service := GetService(r)
 					if service.ConfigFile == "" {
 						render.JSON(w, r, NewError(ErrServiceConfigNotFound))
@@ -113,7 +177,7 @@ func main() {
 					}
 					render.PlainText(w, r, string(data))
 				})
-				r.Post("/config-file", func(w http.ResponseWriter, r *http.Request) {
+				r.With(RequireRole(RoleAdmin)).Post("/config-file", func(w http.ResponseWriter, r *http.Request) {
 					service := GetService(r)
 					if service.ConfigFile == "" {
 						render.JSON(w, r, NewError(ErrServiceConfigNotFound))
@@ -126,23 +190,38 @@ func main() {
 					}
 					defer r.Body.Close()
 					err = os.WriteFile(path.Join("service", service.ConfigFile), data, 0644)
+					Audit(r, "config-file", service.ConfigFile, err)
 					if err != nil {
 						render.JSON(w, r, NewError(err))
 						return
 					}
 					render.JSON(w, r, NewData(nil))
 				})
-				r.Post("/restart", RestartHandler)
-				r.Post("/upload", UploadHandler)
-				r.Post("/start", StartHandler)
-				r.Post("/stop", StopHandler)
+				r.Get("/releases", ReleasesHandler)
+				r.Get("/runs", RunsHandler)
+				r.Get("/stats", StatsHandler)
+				r.Group(func(r chi.Router) {
+					r.Use(RequireRole(RoleOperator))
+					r.Post("/restart", RestartHandler)
+					r.Post("/upload", UploadHandler)
+					r.Post("/releases/{id}/rollback", RollbackHandler)
+					r.Post("/start", StartHandler)
+					r.Post("/stop", StopHandler)
+				})
 				r.Get("/output", GetOutputHandler)
+				r.Get("/logs", LogsHandler)
 				r.Get("/log", func(w http.ResponseWriter, r *http.Request) {
 					service := GetService(r)
-					render.JSON(w, r, NewData(service.runner.LogFiles()))
+					render.JSON(w, r, NewData(service.Runner().LogFiles()))
 				})
 				r.Get("/log/{file}", func(w http.ResponseWriter, r *http.Request) {
 					file := chi.URLParam(r, "file")
+					// only the files of this service, so that grants on other services are kept
+					if !lo.ContainsBy(GetService(r).Runner().LogFiles(), func(f File) bool { return f.Name == file }) {
+						render.Status(r, http.StatusNotFound)
+						render.JSON(w, r, NewError(ErrLogFileNotFound))
+						return
+					}
 					reader, err := os.Open("log/" + file)
 					if err != nil {
 						fmt.Println(err)
@@ -161,10 +240,6 @@ func main() {
 		})
 	})
 
-	if config.Port == 0 {
-		config.Port = 8080
-	}
-
 	fmt.Printf("listening on port: %d\n", config.Port)
 	if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Port), r); err != nil {
 		panic(err)
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/samber/lo"
+)
+
+type requestKey struct {
+	Method string
+	Route  string
+	Code   int
+}
+
+type requestStat struct {
+	Count    int64
+	Duration float64
+}
+
+// Metrics holds the counters that are not kept anywhere else.
+type Metrics struct {
+	lock     sync.Mutex
+	logBytes map[string]map[Channel]int64
+	uploads  map[string]map[string]int64
+	requests map[requestKey]*requestStat
+}
+
+var metrics = Metrics{
+	logBytes: map[string]map[Channel]int64{},
+	uploads:  map[string]map[string]int64{},
+	requests: map[requestKey]*requestStat{},
+}
+
+func (m *Metrics) AddLogBytes(service string, stream Channel, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.logBytes[service] == nil {
+		m.logBytes[service] = map[Channel]int64{}
+	}
+	m.logBytes[service][stream] += int64(n)
+}
+
+func (m *Metrics) AddUpload(service string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.uploads[service] == nil {
+		m.uploads[service] = map[string]int64{}
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.uploads[service][outcome]++
+}
+
+// Instrument records the count and duration of requests by route and status code.
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		// raw paths of unmatched requests would give the series an unbounded cardinality
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		key := requestKey{Method: r.Method, Route: route, Code: code}
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		stat := m.requests[key]
+		if stat == nil {
+			stat = &requestStat{}
+			m.requests[key] = stat
+		}
+		stat.Count++
+		stat.Duration += time.Since(start).Seconds()
+	})
+}
+
+type promWriter struct {
+	w io.Writer
+}
+
+func (p promWriter) header(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample, labels are given as name, value pairs.
+func (p promWriter) sample(name string, value float64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(p.w, "%s %v\n", name, value)
+}
+
+// replicaLabels labels a sample with the service, and the replica for services with replicas.
+func replicaLabels(id string) []string {
+	exec, index := splitID(id)
+	if index == "" {
+		return []string{"service", exec}
+	}
+	return []string{"service", exec, "replica", index}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *Engine) writeMetrics(p promWriter, visible func(service string) bool) {
+	type gauge struct {
+		name, kind, help string
+		value            func(s *Service, u Usage) (float64, bool)
+	}
+	gauges := []gauge{
+		{"emu_service_up", "gauge", "Whether the service process is running.", func(s *Service, u Usage) (float64, bool) {
+			return boolValue(s.IsRunning()), true
+		}},
+		{"emu_service_healthy", "gauge", "Whether the service passes its health check.", func(s *Service, u Usage) (float64, bool) {
+			return boolValue(s.Runner().Health() == HealthHealthy), s.Health != nil
+		}},
+		{"emu_service_cpu_percent", "gauge", "CPU usage of the service process.", func(s *Service, u Usage) (float64, bool) {
+			return u.CPU, s.IsRunning()
+		}},
+		{"emu_service_rss_bytes", "gauge", "Resident memory of the service process.", func(s *Service, u Usage) (float64, bool) {
+			return float64(u.Mem), s.IsRunning()
+		}},
+		{"emu_service_fds", "gauge", "Open file descriptors of the service process.", func(s *Service, u Usage) (float64, bool) {
+			return float64(u.FDNum), s.IsRunning()
+		}},
+		{"emu_service_threads", "gauge", "Threads of the service process.", func(s *Service, u Usage) (float64, bool) {
+			return float64(u.Threads), s.IsRunning()
+		}},
+		{"emu_service_uptime_seconds", "gauge", "Time since the service process started.", func(s *Service, u Usage) (float64, bool) {
+			runs := s.runs.List()
+			if len(runs) == 0 || !runs[0].Running() {
+				return 0, false
+			}
+			return runs[0].Uptime.Seconds(), true
+		}},
+		{"emu_service_restarts_total", "counter", "Automatic restarts of the service.", func(s *Service, u Usage) (float64, bool) {
+			return float64(s.RestartCount()), true
+		}},
+		{"emu_service_last_exit_code", "gauge", "Exit code of the last run of the service.", func(s *Service, u Usage) (float64, bool) {
+			code := s.runs.LastExitCode()
+			if code == nil {
+				return 0, false
+			}
+			return float64(*code), true
+		}},
+	}
+
+	services := lo.Filter(e.Services(), func(s *Service, i int) bool { return visible(s.Exec) })
+	usages := lo.Map(services, func(s *Service, i int) Usage { return s.Runner().Usage() })
+	for _, g := range gauges {
+		p.header(g.name, g.kind, g.help)
+		for i, s := range services {
+			if value, ok := g.value(s, usages[i]); ok {
+				p.sample(g.name, value, append(replicaLabels(s.ID()), "name", s.Name)...)
+			}
+		}
+	}
+}
+
+// write writes the counters of the visible services, and the ones of emu
+// itself when global is set.
+func (m *Metrics) write(p promWriter, visible func(service string) bool, global bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p.header("emu_service_log_bytes_total", "counter", "Bytes of output captured from the service.")
+	for _, service := range sortedKeys(m.logBytes) {
+		if exec, _ := splitID(service); !visible(exec) {
+			continue
+		}
+		for _, stream := range []Channel{Stdout, Stderr} {
+			p.sample("emu_service_log_bytes_total", float64(m.logBytes[service][stream]), append(replicaLabels(service), "stream", string(stream))...)
+		}
+	}
+
+	p.header("emu_service_uploads_total", "counter", "Uploads of new releases of the service.")
+	for _, service := range sortedKeys(m.uploads) {
+		if !visible(service) {
+			continue
+		}
+		for _, outcome := range sortedKeys(m.uploads[service]) {
+			p.sample("emu_service_uploads_total", float64(m.uploads[service][outcome]), "service", service, "outcome", outcome)
+		}
+	}
+
+	if !global {
+		return
+	}
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	p.header("emu_http_requests_total", "counter", "HTTP requests served by emu.")
+	for _, key := range keys {
+		p.sample("emu_http_requests_total", float64(m.requests[key].Count), "method", key.Method, "route", key.Route, "code", fmt.Sprint(key.Code))
+	}
+	p.header("emu_http_request_duration_seconds", "summary", "Time spent serving HTTP requests.")
+	for _, key := range keys {
+		labels := []string{"method", key.Method, "route", key.Route, "code", fmt.Sprint(key.Code)}
+		p.sample("emu_http_request_duration_seconds_sum", m.requests[key].Duration, labels...)
+		p.sample("emu_http_request_duration_seconds_count", float64(m.requests[key].Count), labels...)
+	}
+
+	p.header("emu_goroutines", "gauge", "Goroutines of emu.")
+	p.sample("emu_goroutines", float64(runtime.NumGoroutine()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format. Only the
+// services the user may view are included, and the metrics of emu itself
+// need the viewer role globally.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	config := GetConfig(r)
+	user := GetUser(r)
+	visible := func(service string) bool {
+		return config.RoleOf(user, service).Allows(RoleViewer)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p := promWriter{w: w}
+	GetEngine(r).writeMetrics(p, visible)
+	metrics.write(p, visible, visible(""))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerGrants(t *testing.T) {
+	config := rbacConfig()
+	engine := &Engine{}
+	engine.setServices([]*Service{{Exec: "api"}, {Exec: "web"}, {Exec: "db"}})
+	handler := WithConfig(func() *Config { return config })(WithEngine(engine)(http.HandlerFunc(MetricsHandler)))
+
+	tests := []struct {
+		user    string
+		visible []string
+		hidden  []string
+	}{
+		{"root", []string{`service="api"`, `service="web"`, "emu_goroutines "}, nil},
+		{"dev", []string{`service="api"`, `service="web"`, "emu_goroutines "}, []string{`service="db"`}},
+		// accounts with grants only see their services, and nothing of emu itself
+		{"guest", []string{`service="api"`}, []string{`service="web"`, `service="db"`, "emu_goroutines "}},
+		{"nobody", nil, []string{`service="api"`, "emu_goroutines "}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, tt.user))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.user, w.Code)
+			continue
+		}
+		body := w.Body.String()
+		for _, s := range tt.visible {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: %s missing from the metrics", tt.user, s)
+			}
+		}
+		for _, s := range tt.hidden {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: %s is in the metrics", tt.user, s)
+			}
+		}
+	}
+}
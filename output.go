@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// OutputOptions select and format the output records sent to a websocket or SSE client.
+type OutputOptions struct {
+	// Stream only sends stdout or stderr, both when empty.
+	Stream Channel
+	// Tail is how many buffered records are sent on join, all of them when negative.
+	Tail  int
+	Since time.Time
+	// JSON sends every record as a JSON object instead of its raw line.
+	JSON bool
+}
+
+var DefaultOutputOptions = &OutputOptions{Tail: -1}
+
+// ParseOutputOptions reads stream, tail, since (RFC3339) and format=json|text.
+func ParseOutputOptions(r *http.Request) (*OutputOptions, error) {
+	query := r.URL.Query()
+	options := &OutputOptions{Stream: Channel(query.Get("stream")), Tail: -1}
+	if options.Stream != "" && options.Stream != Stdout && options.Stream != Stderr {
+		return nil, fmt.Errorf("stream must be stdout or stderr")
+	}
+	var err error
+	if tail := query.Get("tail"); tail != "" {
+		if options.Tail, err = strconv.Atoi(tail); err != nil {
+			return nil, err
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		if options.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, err
+		}
+	}
+	switch format := query.Get("format"); format {
+	case "json":
+		options.JSON = true
+	case "", "text":
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return options, nil
+}
+
+func (o *OutputOptions) Match(record LogRecord) bool {
+	if o.Stream != "" && record.Stream != o.Stream {
+		return false
+	}
+	return o.Since.IsZero() || !record.Time.Before(o.Since)
+}
+
+// backfill returns the buffered events to send on subscribe.
+func (o *OutputOptions) backfill(events []Event) []Event {
+	matched := []Event{}
+	for _, event := range events {
+		if record, ok := event.Data.(LogRecord); !ok || o.Match(record) {
+			matched = append(matched, event)
+		}
+	}
+	if o.Tail >= 0 && len(matched) > o.Tail {
+		matched = matched[len(matched)-o.Tail:]
+	}
+	return matched
+}
+
+func (o *OutputOptions) Frame(record LogRecord) []byte {
+	if !o.JSON {
+		return record.Text()
+	}
+	data, _ := json.Marshal(record)
+	return data
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/lo"
+)
+
+type Role string
+
+var (
+	RoleNone     Role = ""
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var ErrForbidden = fmt.Errorf("permission denied")
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+func (r Role) Valid() bool {
+	return r == RoleNone || r.rank() > 0
+}
+
+// Allows reports whether the role includes the required one.
+func (r Role) Allows(required Role) bool {
+	return r.rank() >= required.rank()
+}
+
+func (c *Config) Account(username string) *BasicAuth {
+	for _, a := range c.Accounts {
+		if a.Username == username {
+			return a
+		}
+	}
+	return nil
+}
+
+// RoleOf returns the role of the user on the service, or its global role
+// when service is empty. Accounts without any role or grant are admins.
+func (c *Config) RoleOf(username string, service string) Role {
+	account := c.Account(username)
+	if account == nil {
+		return RoleNone
+	}
+	if role, ok := account.Grants[service]; ok && service != "" {
+		return role
+	}
+	if account.Role == RoleNone && len(account.Grants) == 0 {
+		return RoleAdmin
+	}
+	return account.Role
+}
+
+func (c *Config) validateRoles() error {
+	for _, a := range c.Accounts {
+		if !a.Role.Valid() {
+			return fmt.Errorf("account %s: unknown role %q", a.Username, a.Role)
+		}
+		for service, role := range a.Grants {
+			if !role.Valid() {
+				return fmt.Errorf("account %s: unknown role %q for service %s", a.Username, role, service)
+			}
+		}
+	}
+	return nil
+}
+
+type configKey struct{}
+
+func GetConfig(r *http.Request) *Config {
+	return r.Context().Value(configKey{}).(*Config)
+}
+
+func WithConfig(config func() *Config) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ctx = context.WithValue(ctx, configKey{}, config())
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole only lets the request through if the user has at least the
+// role on the service or job in the URL, or globally for routes without one.
+func RequireRole(role Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetUser(r)
+			service := chi.URLParam(r, "service")
+			if service == "" {
+				service = chi.URLParam(r, "job")
+			}
+			if !GetConfig(r).RoleOf(user, service).Allows(role) {
+				render.Status(r, http.StatusForbidden)
+				render.JSON(w, r, NewError(ErrForbidden))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// VisibleServices returns the services the user is allowed to view.
+func VisibleServices(r *http.Request) []*Service {
+	config := GetConfig(r)
+	user := GetUser(r)
+	return lo.Filter(config.Services, func(s *Service, i int) bool {
+		return config.RoleOf(user, s.Exec).Allows(RoleViewer)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func rbacConfig() *Config {
+	return &Config{Accounts: []*BasicAuth{
+		{Username: "root"},
+		{Username: "ops", Role: RoleOperator},
+		{Username: "dev", Role: RoleViewer, Grants: map[string]Role{"api": RoleAdmin, "db": RoleNone}},
+		{Username: "guest", Grants: map[string]Role{"api": RoleViewer}},
+	}}
+}
+
+func TestRoleOf(t *testing.T) {
+	config := rbacConfig()
+	tests := []struct {
+		user    string
+		service string
+		want    Role
+	}{
+		// accounts without any role or grant are admins
+		{"root", "", RoleAdmin},
+		{"root", "api", RoleAdmin},
+		{"ops", "", RoleOperator},
+		{"ops", "api", RoleOperator},
+		// grants override the global role on their service only
+		{"dev", "", RoleViewer},
+		{"dev", "api", RoleAdmin},
+		{"dev", "web", RoleViewer},
+		{"dev", "db", RoleNone},
+		// grants alone do not make an admin
+		{"guest", "", RoleNone},
+		{"guest", "api", RoleViewer},
+		{"guest", "web", RoleNone},
+		{"nobody", "", RoleNone},
+		{"nobody", "api", RoleNone},
+	}
+	for _, tt := range tests {
+		if got := config.RoleOf(tt.user, tt.service); got != tt.want {
+			t.Errorf("RoleOf(%q, %q) = %q, want %q", tt.user, tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role     Role
+		required Role
+		want     bool
+	}{
+		{RoleAdmin, RoleOperator, true},
+		{RoleOperator, RoleOperator, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleNone, RoleViewer, false},
+		{RoleNone, RoleNone, true},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Allows(tt.required); got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	if err := rbacConfig().validateRoles(); err != nil {
+		t.Errorf("valid roles rejected: %v", err)
+	}
+	invalid := []*BasicAuth{
+		{Username: "a", Role: "root"},
+		{Username: "b", Grants: map[string]Role{"api": "owner"}},
+	}
+	for _, account := range invalid {
+		config := &Config{Accounts: []*BasicAuth{account}}
+		if err := config.validateRoles(); err == nil {
+			t.Errorf("account %s: invalid role accepted", account.Username)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	config := rbacConfig()
+	r := chi.NewRouter()
+	r.Use(WithConfig(func() *Config { return config }))
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), userKey{}, r.Header.Get("X-User"))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.With(RequireRole(RoleAdmin)).Get("/config", ok)
+	r.With(RequireRole(RoleOperator)).Post("/service/{service}/restart", ok)
+	r.With(RequireRole(RoleViewer)).Get("/job/{job}", ok)
+
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		want   int
+	}{
+		{"root", http.MethodGet, "/config", http.StatusOK},
+		{"ops", http.MethodGet, "/config", http.StatusForbidden},
+		{"ops", http.MethodPost, "/service/api/restart", http.StatusOK},
+		{"dev", http.MethodPost, "/service/api/restart", http.StatusOK},
+		{"dev", http.MethodPost, "/service/web/restart", http.StatusForbidden},
+		{"guest", http.MethodPost, "/service/api/restart", http.StatusForbidden},
+		{"guest", http.MethodGet, "/job/api", http.StatusOK},
+		{"guest", http.MethodGet, "/job/report", http.StatusForbidden},
+		{"dev", http.MethodGet, "/job/db", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("X-User", tt.user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s %s: status %d, want %d", tt.user, tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrReleaseNotFound = fmt.Errorf("release not found")
+
+// ReleaseNum is the number of releases kept per service, the current one is never pruned.
+var ReleaseNum = 10
+
+var releases = ReleaseStore{root: "binary"}
+
+func init() {
+	numStr, _ := os.LookupEnv("RELEASE_NUM")
+	if numStr != "" {
+		newReleaseNum, _ := strconv.Atoi(numStr)
+		if newReleaseNum > 0 {
+			ReleaseNum = newReleaseNum
+		}
+	}
+}
+
+type Release struct {
+	ID       int       `json:"id"`
+	Time     time.Time `json:"time"`
+	Uploader string    `json:"uploader"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+	File     string    `json:"file"`
+}
+
+type ReleaseHistory struct {
+	Current  int        `json:"current"`
+	Releases []*Release `json:"releases"`
+}
+
+func (h *ReleaseHistory) Get(id int) *Release {
+	for _, release := range h.Releases {
+		if release.ID == id {
+			return release
+		}
+	}
+	return nil
+}
+
+// ReleaseStore keeps every uploaded artifact of a service under binary/<exec>/,
+// along with a releases.json index.
+type ReleaseStore struct {
+	lock sync.Mutex
+	root string
+}
+
+func (s *ReleaseStore) dir(service *Service) string {
+	return filepath.Join(s.root, service.Exec)
+}
+
+func (s *ReleaseStore) load(service *Service) (*ReleaseHistory, error) {
+	history := &ReleaseHistory{Releases: []*Release{}}
+	data, err := os.ReadFile(filepath.Join(s.dir(service), "releases.json"))
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *ReleaseStore) save(service *Service, history *ReleaseHistory) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	index := filepath.Join(s.dir(service), "releases.json")
+	if err := os.WriteFile(index+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(index+".tmp", index)
+}
+
+func (s *ReleaseStore) List(service *Service) (*ReleaseHistory, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load(service)
+}
+
+func (s *ReleaseStore) Get(service *Service, id int) (*Release, error) {
+	history, err := s.List(service)
+	if err != nil {
+		return nil, err
+	}
+	release := history.Get(id)
+	if release == nil {
+		return nil, ErrReleaseNotFound
+	}
+	return release, nil
+}
+
+// Add moves an uploaded file into the store as a new release.
+func (s *ReleaseStore) Add(service *Service, file string, uploader string) (*Release, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	history, err := s.load(service)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir(service), 0755); err != nil {
+		return nil, err
+	}
+
+	id := 1
+	if len(history.Releases) > 0 {
+		id = history.Releases[len(history.Releases)-1].ID + 1
+	}
+	name := strconv.Itoa(id)
+	if service.Packed() {
+		name += ".tar.gz"
+	}
+	release := &Release{
+		ID:       id,
+		Time:     time.Now(),
+		Uploader: uploader,
+		File:     filepath.Join(s.dir(service), name),
+	}
+	if err := os.Rename(file, release.File); err != nil {
+		return nil, err
+	}
+	if release.Size, release.Checksum, err = checksum(release.File); err != nil {
+		return nil, err
+	}
+
+	history.Releases = append(history.Releases, release)
+	s.prune(history)
+	if err := s.save(service, history); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+func (s *ReleaseStore) SetCurrent(service *Service, id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	history, err := s.load(service)
+	if err != nil {
+		return err
+	}
+	if history.Get(id) == nil {
+		return ErrReleaseNotFound
+	}
+	history.Current = id
+	return s.save(service, history)
+}
+
+func (s *ReleaseStore) prune(history *ReleaseHistory) {
+	for len(history.Releases) > ReleaseNum {
+		i := 0
+		if history.Releases[0].ID == history.Current {
+			i = 1
+		}
+		os.Remove(history.Releases[i].File)
+		history.Releases = append(history.Releases[:i], history.Releases[i+1:]...)
+	}
+}
+
+func checksum(file string) (int64, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Stage unpacks the release artifact next to the live executable or folder
+// and returns where it was put.
+func (release *Release) Stage(service *Service) (string, error) {
+	staged := service.ExecPath() + ".new"
+	if service.Packed() {
+		staged = service.ServiceFolder() + ".new"
+	}
+	os.RemoveAll(staged)
+	var err error
+	if service.Packed() {
+		err = ExtractTarGz(release.File, staged)
+	} else {
+		_, err = CopyFile(release.File, staged)
+	}
+	if err != nil {
+		os.RemoveAll(staged)
+		return "", err
+	}
+	return staged, nil
+}
+
+// promote replaces the live executable or folder with a staged one.
+func promote(service *Service, staged string) error {
+	if !service.Packed() {
+		return os.Rename(staged, service.ExecPath())
+	}
+	if err := os.RemoveAll(service.ServiceFolder()); err != nil {
+		return err
+	}
+	return os.Rename(staged, service.ServiceFolder())
+}
+
+// Deploy stages the release, then stops all the replicas of the service, puts
+// the release in place and starts them again. A release that cannot be staged
+// leaves the running replicas alone.
+func (e *Engine) Deploy(service *Service, release *Release) error {
+	staged, err := release.Stage(service)
+	if err != nil {
+		return err
+	}
+	replicas := e.GetReplicas(service.Exec)
+	for _, replica := range replicas {
+		if err := e.StopService(replica.ID()); err != nil {
+			fmt.Println("failed to stop service", replica.ID(), err)
+		}
+	}
+	err = promote(service, staged)
+	if err == nil {
+		err = releases.SetCurrent(service, release.ID)
+	} else {
+		os.RemoveAll(staged)
+	}
+	// the replicas are started again even if the release could not be put in place
+	for _, replica := range replicas {
+		if startErr := e.StartService(replica.ID()); startErr != nil && err == nil {
+			err = startErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestReleaseStore(t *testing.T) {
+	num := ReleaseNum
+	defer func() { ReleaseNum = num }()
+	ReleaseNum = 3
+
+	dir := t.TempDir()
+	store := &ReleaseStore{root: filepath.Join(dir, "binary")}
+	service := &Service{Exec: "api"}
+	upload := func(content string) *Release {
+		file := filepath.Join(dir, "upload")
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		release, err := store.Add(service, file, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return release
+	}
+	ids := func() []int {
+		history, err := store.List(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lo.Map(history.Releases, func(r *Release, i int) int { return r.ID })
+	}
+
+	first := upload("v1")
+	sum := sha256.Sum256([]byte("v1"))
+	if first.ID != 1 || first.Size != 2 || first.Checksum != hex.EncodeToString(sum[:]) || first.Uploader != "alice" {
+		t.Errorf("first release = %+v", first)
+	}
+	if err := store.SetCurrent(service, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetCurrent(service, 42); err != ErrReleaseNotFound {
+		t.Errorf("SetCurrent of an unknown release = %v, want %v", err, ErrReleaseNotFound)
+	}
+
+	// the oldest releases are pruned, except for the current one
+	second := upload("v2")
+	for i := 3; i <= 5; i++ {
+		upload(fmt.Sprintf("v%d", i))
+	}
+	if got := ids(); fmt.Sprint(got) != "[1 4 5]" {
+		t.Errorf("releases = %v, want [1 4 5]", got)
+	}
+	if _, err := os.Stat(first.File); err != nil {
+		t.Errorf("the file of the current release is gone: %v", err)
+	}
+	if _, err := os.Stat(second.File); !os.IsNotExist(err) {
+		t.Errorf("the file of a pruned release is kept: %v", err)
+	}
+	if _, err := store.Get(service, second.ID); err != ErrReleaseNotFound {
+		t.Errorf("Get of a pruned release = %v, want %v", err, ErrReleaseNotFound)
+	}
+
+	// once it is no longer current, the release is pruned as well
+	if err := store.SetCurrent(service, 5); err != nil {
+		t.Fatal(err)
+	}
+	upload("v6")
+	if got := ids(); fmt.Sprint(got) != "[4 5 6]" {
+		t.Errorf("releases = %v, want [4 5 6]", got)
+	}
+	history, _ := store.List(service)
+	if history.Current != 5 {
+		t.Errorf("current release = %d, want 5", history.Current)
+	}
+}
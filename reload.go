@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/go-chi/render"
+)
+
+type ReloadSummary struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Restarted []string `json:"restarted"`
+	Updated   []string `json:"updated"`
+}
+
+// Reloader re-reads the config file and applies it to the running engine.
+type Reloader struct {
+	lock   sync.Mutex
+	path   string
+	engine *Engine
+
+	// config is replaced on reload, never modified in place
+	configLock sync.RWMutex
+	config     *Config
+}
+
+// Config returns the current config.
+func (r *Reloader) Config() *Config {
+	r.configLock.RLock()
+	defer r.configLock.RUnlock()
+	return r.config
+}
+
+func (r *Reloader) setConfig(config *Config) {
+	r.configLock.Lock()
+	defer r.configLock.Unlock()
+	r.config = config
+}
+
+func (r *Reloader) Reload() (*ReloadSummary, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reload()
+}
+
+func (r *Reloader) reload() (*ReloadSummary, error) {
+	config, err := readConfigFromFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	summary := r.engine.Reload(config.Mode, config.Services, config.MetaVars)
+	config.Services = r.engine.Services()
+	config.Jobs = r.engine.SetJobs(config.Jobs)
+	if port := r.Config().Port; config.Port != port {
+		fmt.Println("port changed, restart emu to apply it")
+		config.Port = port
+	}
+	r.setConfig(config)
+	sinks.Configure(config)
+	alerts.Configure(config)
+	return summary, nil
+}
+
+// WatchSignal reloads the config on SIGHUP.
+func (r *Reloader) WatchSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		summary, err := r.Reload()
+		if err != nil {
+			fmt.Println("failed to reload config", err)
+			continue
+		}
+		fmt.Printf("config reloaded: %+v\n", *summary)
+	}
+}
+
+func (rl *Reloader) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	summary, err := rl.Reload()
+	Audit(r, "reload", "", err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(summary))
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// needsRestart reports whether the process has to be restarted to pick up the
+// new definition, the runner keeping its own copy of the health check, stop
+// and log settings.
+func (s *Service) needsRestart(n *Service) bool {
+	return s.Folder != n.Folder || !sameStrings(s.Args, n.Args) || !sameStrings(s.Env, n.Env) ||
+		!reflect.DeepEqual(s.Limits, n.Limits) || !reflect.DeepEqual(s.Health, n.Health) ||
+		!reflect.DeepEqual(s.Log, n.Log) || s.StopSignal != n.StopSignal || s.StopTimeout != n.StopTimeout
+}
+
+// update copies the definition of n into s, keeping the runtime state of s.
+func (s *Service) update(n *Service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Name = n.Name
+	s.Tag = n.Tag
+	s.Folder = n.Folder
+	s.ConfigFile = n.ConfigFile
+	s.Env = n.Env
+	s.Args = n.Args
+	s.Replicas = n.Replicas
+	s.Port = n.Port
+	s.Restart = n.Restart
+	s.Health = n.Health
+	s.Deploy = n.Deploy
+	s.Log = n.Log
+	s.Sinks = n.Sinks
+	s.Limits = n.Limits
+	s.DependsOn = n.DependsOn
+	s.StopSignal = n.StopSignal
+	s.StopTimeout = n.StopTimeout
+}
+
+func (s *Service) sameDefinition(n *Service) bool {
+	return s.Name == n.Name && s.Tag == n.Tag && s.ConfigFile == n.ConfigFile && !s.needsRestart(n) &&
+		reflect.DeepEqual(s.Restart, n.Restart) && reflect.DeepEqual(s.Deploy, n.Deploy) &&
+		reflect.DeepEqual(s.Sinks, n.Sinks) && sameStrings(s.DependsOn, n.DependsOn) &&
+		s.Replicas == n.Replicas && s.Port == n.Port
+}
+
+// Reload applies a new list of services, matched to the current ones by id:
+// new services are started in dependency order, missing ones stopped and
+// changed ones restarted if their folder, args, env, limits, health check,
+// stop or log settings changed.
+func (e *Engine) Reload(mode Mode, services []*Service, meta map[string]string) *ReloadSummary {
+	summary, added := e.reload(mode, services, meta)
+	for _, id := range summary.Removed {
+		hub.Forget(Topic(TopicOutput, id))
+	}
+	for _, err := range e.StartAll(added) {
+		fmt.Println("failed to start service", err)
+	}
+	return summary
+}
+
+// reload applies the new list of services, and returns the added ones for the caller to start.
+func (e *Engine) reload(mode Mode, services []*Service, meta map[string]string) (*ReloadSummary, []*Service) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	summary := &ReloadSummary{Added: []string{}, Removed: []string{}, Restarted: []string{}, Updated: []string{}}
+	e.mode = mode
+	e.meta = meta
+
+	merged := []*Service{}
+	added := []*Service{}
+	kept := map[*Service]bool{}
+	for _, n := range services {
+		s := e.GetService(n.ID())
+		if s == nil {
+			merged = append(merged, n)
+			added = append(added, n)
+			summary.Added = append(summary.Added, n.ID())
+			continue
+		}
+		kept[s] = true
+		merged = append(merged, s)
+		if s.sameDefinition(n) {
+			continue
+		}
+		restart := s.needsRestart(n)
+		s.update(n)
+		if !restart {
+			summary.Updated = append(summary.Updated, s.ID())
+			continue
+		}
+		s.resetSupervision()
+		if err := s.Runner().Stop(); err != nil {
+			fmt.Println("failed to stop service", s.ID(), err)
+		}
+		runner := e.newRunner(s)
+		s.setRunner(runner)
+		if err := runner.Start(); err != nil {
+			fmt.Println("failed to start service", s.ID(), err)
+		}
+		summary.Restarted = append(summary.Restarted, s.ID())
+	}
+
+	for _, s := range e.Services() {
+		if kept[s] {
+			continue
+		}
+		s.resetSupervision()
+		if err := s.Runner().Stop(); err != nil {
+			fmt.Println("failed to stop service", s.ID(), err)
+		}
+		summary.Removed = append(summary.Removed, s.ID())
+	}
+	e.setServices(merged)
+	return summary, added
+}
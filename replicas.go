@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+var ErrReplicaNotFound = fmt.Errorf("replica not found")
+
+func (s *Service) replicated() bool {
+	return s.Replicas > 1
+}
+
+// ID identifies a replica: the exec, followed by @index for services with replicas.
+func (s *Service) ID() string {
+	if s.id != "" {
+		return s.id
+	}
+	if s.replicated() {
+		return fmt.Sprintf("%s@%d", s.Exec, s.index)
+	}
+	return s.Exec
+}
+
+// port is the base port plus the index of the replica.
+func (s *Service) port() string {
+	if s.Port == 0 {
+		return ""
+	}
+	return strconv.Itoa(s.Port + s.index)
+}
+
+// replicaVars are replaced in args, env and meta files like meta variables.
+func (s *Service) replicaVars() map[string]string {
+	return map[string]string{"{{.Index}}": strconv.Itoa(s.index), "{{.Port}}": s.port()}
+}
+
+func (s *Service) replaceVars(values []string) []string {
+	vars := s.replicaVars()
+	return lo.Map(values, func(value string, i int) string {
+		for key, v := range vars {
+			value = strings.ReplaceAll(value, key, v)
+		}
+		return value
+	})
+}
+
+// replaceHealthVars returns a copy of the health check that probes this replica.
+func (s *Service) replaceHealthVars(check *HealthCheck) *HealthCheck {
+	if check == nil {
+		return nil
+	}
+	replaced := *check
+	replaced.HTTP = s.replaceVars([]string{check.HTTP})[0]
+	replaced.TCP = s.replaceVars([]string{check.TCP})[0]
+	replaced.Exec = s.replaceVars(check.Exec)
+	return &replaced
+}
+
+// metaFile is the file the meta file @name is written to, each replica gets its own.
+func (s *Service) metaFile(file string) string {
+	if !s.replicated() {
+		return file
+	}
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(file, ext), s.index, ext)
+}
+
+// expandReplicas turns every service with replicas into one service per replica.
+func expandReplicas(services []*Service) []*Service {
+	expanded := []*Service{}
+	for _, s := range services {
+		if !s.replicated() {
+			s.Args = s.replaceVars(s.Args)
+			s.Env = s.replaceVars(s.Env)
+			s.Health = s.replaceHealthVars(s.Health)
+			s.id = s.ID()
+			expanded = append(expanded, s)
+			continue
+		}
+		for i := 0; i < s.Replicas; i++ {
+			replica := &Service{Exec: s.Exec, index: i}
+			replica.update(s)
+			replica.Args = replica.replaceVars(s.Args)
+			replica.Env = replica.replaceVars(s.Env)
+			// each replica probes its own port, for its health and for the
+			// readiness of the services depending on it
+			replica.Health = replica.replaceHealthVars(s.Health)
+			replica.id = replica.ID()
+			expanded = append(expanded, replica)
+		}
+	}
+	return expanded
+}
+
+// splitID splits the id of a replica into its exec and index, which is empty
+// for services without replicas.
+func splitID(id string) (string, string) {
+	if i := strings.LastIndex(id, "@"); i >= 0 {
+		if _, err := strconv.Atoi(id[i+1:]); err == nil {
+			return id[:i], id[i+1:]
+		}
+	}
+	return id, ""
+}
+
+// GetReplicas returns all the replicas of the service.
+func (e *Engine) GetReplicas(exec string) []*Service {
+	return lo.Filter(e.Services(), func(s *Service, i int) bool { return s.Exec == exec })
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type RestartPolicy string
+
+var (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+type RestartConfig struct {
+	Policy     RestartPolicy `yaml:"policy" json:"policy"`
+	Backoff    time.Duration `yaml:"backoff" json:"backoff"`
+	MaxBackoff time.Duration `yaml:"max-backoff" json:"maxBackoff"`
+	MaxRetries int           `yaml:"max-retries" json:"maxRetries"`
+	Window     time.Duration `yaml:"window" json:"window"`
+}
+
+func (c *RestartConfig) policy() RestartPolicy {
+	if c == nil || c.Policy == "" {
+		return RestartNever
+	}
+	return c.Policy
+}
+
+func (c *RestartConfig) backoff(attempt int) time.Duration {
+	base, max := time.Second, time.Minute
+	if c.Backoff > 0 {
+		base = c.Backoff
+	}
+	if c.MaxBackoff > 0 {
+		max = c.MaxBackoff
+	}
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (c *RestartConfig) maxRetries() int {
+	if c.MaxRetries > 0 {
+		return c.MaxRetries
+	}
+	return 5
+}
+
+func (c *RestartConfig) window() time.Duration {
+	if c.Window > 0 {
+		return c.Window
+	}
+	return 5 * time.Minute
+}
+
+type ServiceState string
+
+var (
+	StateStopped      ServiceState = "stopped"
+	StateStarting     ServiceState = "starting"
+	StateRunning      ServiceState = "running"
+	StateUnhealthy    ServiceState = "unhealthy"
+	StateExited       ServiceState = "exited"
+	StateBackoff      ServiceState = "backoff"
+	StateCrashLooping ServiceState = "crash-looping"
+)
+
+func (s *Service) State() ServiceState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.Running {
+		switch s.runner.Health() {
+		case HealthStarting:
+			return StateStarting
+		case HealthUnhealthy:
+			return StateUnhealthy
+		}
+		return StateRunning
+	}
+	if s.state != "" {
+		return s.state
+	}
+	return StateStopped
+}
+
+// resetSupervision cancels a pending automatic restart, called whenever
+// someone starts or stops the service by hand.
+func (s *Service) resetSupervision() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.retry != nil {
+		s.retry.Stop()
+		s.retry = nil
+	}
+	s.state = ""
+	s.restarts = nil
+}
+
+// supervise is called when a runner's process exits without emu asking it to,
+// and schedules a restart according to the service's restart policy.
+func (e *Engine) supervise(s *Service, r *Runner, exitErr error) {
+	fmt.Println(s.ID(), "exited:", exitErr)
+	if exitErr != nil {
+		alerts.Fire(s.ID(), AlertCrashed, exitErr.Error())
+	} else {
+		alerts.Fire(s.ID(), AlertCrashed, "exited unexpectedly")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	policy := s.Restart.policy()
+	if policy == RestartNever || (policy == RestartOnFailure && exitErr == nil) {
+		s.state = StateExited
+		return
+	}
+
+	now := time.Now()
+	recent := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < s.Restart.window() {
+			recent = append(recent, t)
+		}
+	}
+	s.restarts = recent
+	if len(s.restarts) >= s.Restart.maxRetries() {
+		fmt.Println(s.ID(), "is crash-looping, giving up after", len(s.restarts), "restarts")
+		alerts.Fire(s.ID(), AlertRestartLoop, fmt.Sprintf("gave up after %d restarts in %s", len(s.restarts), s.Restart.window()))
+		s.state = StateCrashLooping
+		publishLifecycle(LifecycleEvent{Service: s.ID(), Step: LifecycleCrashLooping})
+		return
+	}
+
+	delay := s.Restart.backoff(len(s.restarts))
+	s.restarts = append(s.restarts, now)
+	s.state = StateBackoff
+	fmt.Println(s.ID(), "restarting in", delay)
+	publishLifecycle(LifecycleEvent{Service: s.ID(), Step: LifecycleRestarting, Message: "in " + delay.String()})
+	s.retry = time.AfterFunc(delay, func() { e.restartCrashed(s, r) })
+}
+
+func (e *Engine) restartCrashed(s *Service, crashed *Runner) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if s.Runner() != crashed {
+		// someone started or stopped the service in the meantime
+		return
+	}
+
+	s.countRestart()
+	runner := e.newRunner(s)
+	s.setRunner(runner)
+	if err := runner.Start(); err != nil {
+		fmt.Println("failed to restart service", s.ID(), err)
+		e.supervise(s, runner, err)
+	}
+}
+
+// RestartCount is the number of automatic restarts since emu started.
+func (s *Service) RestartCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.restartCount
+}
+
+func (s *Service) countRestart() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restartCount++
+}
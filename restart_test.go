@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	go hub.Start()
+	os.Exit(m.Run())
+}
+
+func TestRestartBackoff(t *testing.T) {
+	tests := []struct {
+		config  RestartConfig
+		attempt int
+		want    time.Duration
+	}{
+		{RestartConfig{}, 0, time.Second},
+		{RestartConfig{}, 1, 2 * time.Second},
+		{RestartConfig{}, 3, 8 * time.Second},
+		{RestartConfig{}, 10, time.Minute},
+		{RestartConfig{Backoff: 100 * time.Millisecond}, 2, 400 * time.Millisecond},
+		{RestartConfig{Backoff: time.Second, MaxBackoff: 3 * time.Second}, 2, 3 * time.Second},
+		{RestartConfig{Backoff: 10 * time.Second, MaxBackoff: 5 * time.Second}, 0, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.config.backoff(tt.attempt); got != tt.want {
+			t.Errorf("%+v backoff(%d) = %s, want %s", tt.config, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// superviseService is a service whose automatic restarts never come due during a test.
+func superviseService(policy RestartPolicy) *Service {
+	return &Service{Exec: "test", Restart: &RestartConfig{Policy: policy, Backoff: time.Hour, MaxRetries: 2, Window: time.Minute}}
+}
+
+func TestSupervisePolicy(t *testing.T) {
+	crash := errors.New("exit status 1")
+	tests := []struct {
+		policy RestartPolicy
+		err    error
+		want   ServiceState
+	}{
+		{"", crash, StateExited},
+		{RestartNever, crash, StateExited},
+		{RestartOnFailure, nil, StateExited},
+		{RestartOnFailure, crash, StateBackoff},
+		{RestartAlways, nil, StateBackoff},
+		{RestartAlways, crash, StateBackoff},
+	}
+	e := &Engine{}
+	for _, tt := range tests {
+		s := superviseService(tt.policy)
+		if tt.policy == "" {
+			s.Restart = nil
+		}
+		e.supervise(s, nil, tt.err)
+		if got := s.State(); got != tt.want {
+			t.Errorf("policy %q, exit %v: state = %s, want %s", tt.policy, tt.err, got, tt.want)
+		}
+		if scheduled := s.retry != nil; scheduled != (tt.want == StateBackoff) {
+			t.Errorf("policy %q, exit %v: restart scheduled = %v", tt.policy, tt.err, scheduled)
+		}
+		s.resetSupervision()
+	}
+}
+
+func TestSuperviseCrashLoop(t *testing.T) {
+	e := &Engine{}
+	s := superviseService(RestartAlways)
+	defer s.resetSupervision()
+
+	for i := 0; i < 2; i++ {
+		e.supervise(s, nil, errors.New("crash"))
+		if got := s.State(); got != StateBackoff {
+			t.Fatalf("crash %d: state = %s, want %s", i, got, StateBackoff)
+		}
+	}
+	e.supervise(s, nil, errors.New("crash"))
+	if got := s.State(); got != StateCrashLooping {
+		t.Fatalf("state = %s, want %s", got, StateCrashLooping)
+	}
+}
+
+func TestSuperviseWindow(t *testing.T) {
+	e := &Engine{}
+	s := superviseService(RestartAlways)
+	defer s.resetSupervision()
+
+	// restarts older than the window are forgotten
+	s.restarts = []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(-90 * time.Second)}
+	e.supervise(s, nil, errors.New("crash"))
+	if got := s.State(); got != StateBackoff {
+		t.Fatalf("state = %s, want %s", got, StateBackoff)
+	}
+	if len(s.restarts) != 1 {
+		t.Errorf("got %d recent restarts, want 1", len(s.restarts))
+	}
+}
+
+func TestResetSupervision(t *testing.T) {
+	e := &Engine{}
+	s := superviseService(RestartAlways)
+	e.supervise(s, nil, errors.New("crash"))
+	s.resetSupervision()
+	if s.retry != nil || len(s.restarts) != 0 {
+		t.Error("the pending restart was not cancelled")
+	}
+	if got := s.State(); got != StateStopped {
+		t.Errorf("state = %s, want %s", got, StateStopped)
+	}
+}
+
+func TestRestartCrashedSkipsReplacedRunner(t *testing.T) {
+	e := &Engine{}
+	s := superviseService(RestartAlways)
+	s.setRunner(&Runner{})
+	e.restartCrashed(s, &Runner{})
+	if got := s.RestartCount(); got != 0 {
+		t.Errorf("restart count = %d, want 0", got)
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"sync"
 )
 
 type CircularBuffer struct {
 	mu       sync.Mutex
-	buffer   []bytes.Buffer
+	buffer   []Event
 	capacity int
 	head     int
 	size     int
@@ -15,12 +14,12 @@ type CircularBuffer struct {
 
 func NewCircularBuffer(capacity int) *CircularBuffer {
 	return &CircularBuffer{
-		buffer:   make([]bytes.Buffer, capacity),
+		buffer:   make([]Event, capacity),
 		capacity: capacity,
 	}
 }
 
-func (c *CircularBuffer) Write(p []byte) {
+func (c *CircularBuffer) Write(event Event) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -28,8 +27,7 @@ func (c *CircularBuffer) Write(p []byte) {
 		c.size++
 	}
 
-	c.buffer[c.head].Reset()
-	c.buffer[c.head].Write(p)
+	c.buffer[c.head] = event
 
 	c.head = (c.head + 1) % c.capacity
 }
@@ -42,20 +40,18 @@ func (c *CircularBuffer) Reset() {
 	c.size = 0
 }
 
-func (c *CircularBuffer) GetAll() [][]byte {
+func (c *CircularBuffer) GetAll() []Event {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	result := make([][]byte, c.size)
+	result := make([]Event, c.size)
 
 	if c.size < c.capacity {
-		for i := 0; i < c.size; i++ {
-			result[i] = c.buffer[i].Bytes()
-		}
+		copy(result, c.buffer[:c.size])
 		return result
 	} else {
 		for i := 0; i < c.capacity; i++ {
-			result[i] = c.buffer[(i+c.head)%c.capacity].Bytes()
+			result[i] = c.buffer[(i+c.head)%c.capacity]
 		}
 	}
 	return result
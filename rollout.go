@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/lo"
+)
+
+var ErrRolloutNotFound = fmt.Errorf("rollout not found")
+var ErrRolloutRunning = fmt.Errorf("another rollout is running")
+
+// RolloutNum is the number of finished rollouts kept in memory.
+var RolloutNum = 20
+
+type RolloutStatus string
+
+var (
+	RolloutRunning RolloutStatus = "running"
+	RolloutDone    RolloutStatus = "done"
+	RolloutFailed  RolloutStatus = "failed"
+)
+
+type RolloutRequest struct {
+	// Services are execs, for all their replicas, or ids of single replicas.
+	Services []string `json:"services"`
+	// Tag adds the services of the group.
+	Tag string `json:"tag"`
+	// Batch is how many are restarted at once, 1 by default.
+	Batch int `json:"batch"`
+	// Timeout is how long to wait for each batch to get ready, 1m by default.
+	Timeout string `json:"timeout"`
+}
+
+// Rollout restarts services batch by batch, waiting for each batch to be
+// ready before going on, and stops at the first one that fails.
+type Rollout struct {
+	ID      int           `json:"id"`
+	User    string        `json:"user"`
+	Targets []string      `json:"targets"`
+	Batch   int           `json:"batch"`
+	Timeout time.Duration `json:"timeout"`
+	Status  RolloutStatus `json:"status"`
+	Done    []string      `json:"done"`
+	Failed  string        `json:"failed,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+
+	lock sync.Mutex
+}
+
+// RolloutEvent is a step of a rollout, published on rollout/<id>.
+type RolloutEvent struct {
+	Rollout int       `json:"rollout"`
+	Time    time.Time `json:"time"`
+	// Step is one of restarting, ready, failed, done.
+	Step   string `json:"step"`
+	Target string `json:"target,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (ro *Rollout) topic() string {
+	return Topic(TopicRollout, strconv.Itoa(ro.ID))
+}
+
+func (ro *Rollout) event(step string, target string, err error) {
+	event := RolloutEvent{Rollout: ro.ID, Time: time.Now(), Step: step, Target: target}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	fmt.Println("rollout", ro.ID, step, target, event.Error)
+	hub.Publish(ro.topic(), event)
+}
+
+func (ro *Rollout) finish(target string, err error) {
+	ro.lock.Lock()
+	ro.End = time.Now()
+	ro.Status = RolloutDone
+	if err != nil {
+		ro.Status = RolloutFailed
+		ro.Failed = target
+		ro.Error = err.Error()
+	}
+	ro.lock.Unlock()
+	if err != nil {
+		ro.event("failed", target, err)
+		return
+	}
+	ro.event("done", "", nil)
+}
+
+func (ro *Rollout) MarshalJSON() ([]byte, error) {
+	ro.lock.Lock()
+	defer ro.lock.Unlock()
+	type rollout Rollout
+	return json.Marshal((*rollout)(ro))
+}
+
+type RolloutStore struct {
+	lock     sync.Mutex
+	rollouts []*Rollout
+	next     int
+}
+
+var rollouts = RolloutStore{}
+
+// Add registers a new rollout, unless another one is still running.
+func (s *RolloutStore) Add(ro *Rollout) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.rollouts {
+		r.lock.Lock()
+		running := r.Status == RolloutRunning
+		r.lock.Unlock()
+		if running {
+			return ErrRolloutRunning
+		}
+	}
+	s.next++
+	ro.ID = s.next
+	s.rollouts = append(s.rollouts, ro)
+	if len(s.rollouts) > RolloutNum {
+		for _, old := range s.rollouts[:len(s.rollouts)-RolloutNum] {
+			hub.Forget(old.topic())
+		}
+		s.rollouts = s.rollouts[len(s.rollouts)-RolloutNum:]
+	}
+	return nil
+}
+
+func (s *RolloutStore) Get(id int) *Rollout {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ro, _ := lo.Find(s.rollouts, func(ro *Rollout) bool { return ro.ID == id })
+	return ro
+}
+
+// rolloutTargets resolves the requested services to replica ids, in order.
+func (e *Engine) rolloutTargets(req *RolloutRequest) ([]*Service, error) {
+	targets := []*Service{}
+	for _, name := range req.Services {
+		if s := e.GetService(name); s != nil {
+			targets = append(targets, s)
+			continue
+		}
+		replicas := e.GetReplicas(name)
+		if len(replicas) == 0 {
+			return nil, fmt.Errorf("%s: %w", name, ErrServiceNotFound)
+		}
+		targets = append(targets, replicas...)
+	}
+	if req.Tag != "" {
+		group := e.GetGroup(req.Tag)
+		if len(group) == 0 {
+			return nil, fmt.Errorf("tag %s: %w", req.Tag, ErrServiceNotFound)
+		}
+		targets = append(targets, group...)
+	}
+	return lo.Uniq(targets), nil
+}
+
+// Rollout restarts the targets of the rollout batch by batch.
+func (e *Engine) Rollout(ro *Rollout) {
+	for i := 0; i < len(ro.Targets); i += ro.Batch {
+		batch := ro.Targets[i:lo.Min([]int{i + ro.Batch, len(ro.Targets)})]
+		for _, id := range batch {
+			ro.event("restarting", id, nil)
+			if err := e.Restart(id); err != nil {
+				ro.finish(id, err)
+				return
+			}
+		}
+		for _, id := range batch {
+			s := e.GetService(id)
+			if s == nil {
+				ro.finish(id, ErrServiceNotFound)
+				return
+			}
+			if err := s.WaitReady(ro.Timeout); err != nil {
+				ro.finish(id, err)
+				return
+			}
+			ro.lock.Lock()
+			ro.Done = append(ro.Done, id)
+			ro.lock.Unlock()
+			ro.event("ready", id, nil)
+		}
+	}
+	ro.finish("", nil)
+}
+
+func RolloutHandler(w http.ResponseWriter, r *http.Request) {
+	engine := GetEngine(r)
+	config := GetConfig(r)
+	user := GetUser(r)
+	req := &RolloutRequest{}
+	if err := render.DecodeJSON(r.Body, req); err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	ro := &Rollout{User: user, Batch: lo.Max([]int{req.Batch, 1}), Timeout: DependencyTimeout, Status: RolloutRunning, Done: []string{}, Start: time.Now()}
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			render.JSON(w, r, NewError(err))
+			return
+		}
+		ro.Timeout = timeout
+	}
+	targets, err := engine.rolloutTargets(req)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	if len(targets) == 0 {
+		render.JSON(w, r, NewError(ErrServiceNotFound))
+		return
+	}
+	for _, s := range targets {
+		if !config.RoleOf(user, s.Exec).Allows(RoleOperator) {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, NewError(ErrForbidden))
+			return
+		}
+	}
+	ro.Targets = lo.Map(targets, func(s *Service, i int) string { return s.ID() })
+
+	err = rollouts.Add(ro)
+	Audit(r, "rollout", strings.Join(ro.Targets, ","), err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	go engine.Rollout(ro)
+	render.JSON(w, r, NewData(ro))
+}
+
+func getRollout(r *http.Request) *Rollout {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil
+	}
+	return rollouts.Get(id)
+}
+
+func GetRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	ro := getRollout(r)
+	if ro == nil {
+		render.JSON(w, r, NewError(ErrRolloutNotFound))
+		return
+	}
+	render.JSON(w, r, NewData(ro))
+}
+
+// RolloutProgressHandler streams the events of the rollout, from its start, over a websocket.
+func RolloutProgressHandler(w http.ResponseWriter, r *http.Request) {
+	ro := getRollout(r)
+	if ro == nil {
+		render.JSON(w, r, NewError(ErrRolloutNotFound))
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	hub.Join(ro.topic(), conn, DefaultOutputOptions)
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
@@ -17,7 +18,6 @@ import (
 
 	"github.com/samber/lo"
 	"github.com/shirou/gopsutil/v3/process"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type Runner struct {
@@ -30,13 +30,40 @@ type Runner struct {
 
 	onStart func()
 	onStop  func()
+	onExit  func(err error)
+
+	onStopped   func(result StopResult)
+	history     *RunHistory
+	logConfig   *LogConfig
+	run         *Run
+	stopSignal  syscall.Signal
+	stopTimeout time.Duration
+
+	onUnhealthy func()
+	healthCheck *HealthCheck
+	health      Health
+
+	limits *LimitsConfig
+	cgroup *cgroup
+
+	// stopping is set once emu asks the process to stop, so that its exit
+	// is not mistaken for a crash, guarded by lock.
+	stopping bool
+	started  chan struct{}
+	exited   chan struct{}
 
 	fdNum       int
+	threads     int
 	mem         int
 	cpu         float64
 	connections []string
 	paths       []string
 	lastCheck   time.Time
+	cpuTime     float64
+	readBytes   uint64
+	writeBytes  uint64
+
+	lock sync.Mutex
 }
 
 type Channel string
@@ -58,19 +85,34 @@ type File struct {
 	Size int    `json:"size"`
 }
 
-func (r *Runner) LogFiles() []File {
-	files := []File{
-		{Name: fmt.Sprintf("%s-%s.%s.log", r.exec, r.mode, Stdout)},
-		{Name: fmt.Sprintf("%s-%s.%s.log", r.exec, r.mode, Stderr)},
+func (r *Runner) logFile(channel Channel) string {
+	return fmt.Sprintf("%s-%s.%s.log", r.exec, r.mode, channel)
+}
+
+// logFiles returns the current and rotated log files of the channel, oldest first.
+func (r *Runner) logFiles(channel Channel) []string {
+	if r == nil {
+		return []string{}
 	}
+	current := r.logFile(channel)
+	prefix := strings.TrimSuffix(current, ".log") + "-"
+	backups, _ := filepath.Glob(filepath.Join("log", prefix+"*.log"))
+	compressed, _ := filepath.Glob(filepath.Join("log", prefix+"*.log.gz"))
+	files := lo.Map(append(backups, compressed...), func(file string, i int) string { return filepath.Base(file) })
+	sort.Strings(files)
+	return append(files, current)
+}
+
+var ErrLogFileNotFound = fmt.Errorf("log file not found")
+
+func (r *Runner) LogFiles() []File {
 	ret := []File{}
-	for _, file := range files {
-		fs, err := os.Stat("log/" + file.Name)
+	for _, name := range append(r.logFiles(Stdout), r.logFiles(Stderr)...) {
+		fs, err := os.Stat("log/" + name)
 		if err != nil {
 			continue
 		}
-		file.Size = int(fs.Size())
-		ret = append(ret, file)
+		ret = append(ret, File{Name: name, Size: int(fs.Size())})
 	}
 	return ret
 }
@@ -78,56 +120,89 @@ func (r *Runner) LogFiles() []File {
 func (r *Runner) read(reader io.ReadCloser, channel Channel, wg *sync.WaitGroup) error {
 	defer reader.Close()
 	defer fmt.Println(r.exec, "reader closed")
-	content := make([]byte, 1024*2)
-	loggerOut := &lumberjack.Logger{
-		Filename:   fmt.Sprintf("log/%s-%s.%s.log", r.exec, r.mode, channel),
-		MaxSize:    100,
-		MaxBackups: 3,
-		MaxAge:     28,
-	}
-	logger := log.New(loggerOut, "", log.LstdFlags)
-	hub.Reset(r.exec)
-	for {
-		if n, err := reader.Read(content); err != nil {
-			wg.Done()
-			return err
-		} else {
-			str := string(content[:n])
-			hub.msgC <- Msg{Content: str, Channel: r.exec}
-			logger.Println("> ", str)
-		}
+	defer wg.Done()
+	loggerOut := r.logConfig.Logger("log/" + r.logFile(channel))
+	defer loggerOut.Close()
+	encoder := json.NewEncoder(loggerOut)
+	encoder.SetEscapeHTML(false)
+	hub.Reset(Topic(TopicOutput, r.exec))
+	// the run is only known once the process started
+	<-r.started
+	run := 0
+	if r.run != nil {
+		run = r.run.ID
 	}
+	return readLines(reader, channel, func(record LogRecord) {
+		record.Run = run
+		hub.Publish(Topic(TopicOutput, r.exec), record)
+		sinks.Write(r.exec, record)
+		metrics.AddLogBytes(r.exec, channel, len(record.Line)+1)
+		encoder.Encode(record)
+	})
 }
 
+// Stop sends the stop signal and waits for the process to exit, killing
+// its whole process group once the stop timeout is over. The runner is nil
+// for services not started yet.
 func (r *Runner) Stop() error {
-	if r.cmd.Process != nil {
-		defer func() { r.cmd.Process = nil }()
-		if err := r.cmd.Process.Signal(os.Interrupt); err != nil {
-			fmt.Println("failed to send signal", err)
-		}
-		time.Sleep(time.Millisecond * 100)
-		defer r.onStop()
-		if err := r.cmd.Process.Kill(); err != nil {
-			fmt.Println("failed to kill", err)
-		}
-		time.Sleep(time.Millisecond * 100)
+	if r == nil || r.cmd.Process == nil {
+		return nil
+	}
+	select {
+	case <-r.exited:
+		return nil
+	default:
+	}
+	r.lock.Lock()
+	r.stopping = true
+	r.lock.Unlock()
+	if err := r.cmd.Process.Signal(r.stopSignal); err != nil {
+		fmt.Println("failed to send signal", err)
+	}
 
-		if err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGKILL); err != nil {
-			return err
+	result := StopGraceful
+	select {
+	case <-r.exited:
+	case <-time.After(r.stopTimeout):
+		fmt.Println(r.exec, "did not stop in", r.stopTimeout, "killing it")
+		result = StopForced
+	}
+	// also clean up whatever the process left behind in its group
+	if err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		fmt.Println("failed to kill", err)
+	}
+	if result == StopForced {
+		select {
+		case <-r.exited:
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("process %d did not exit after SIGKILL", r.cmd.Process.Pid)
 		}
-		r.cmd.Process.Release()
 	}
+	r.history.SetStopResult(r.run, result)
+	r.onStopped(result)
 	return nil
 }
 
+func (r *Runner) isStopping() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stopping
+}
+
 func (r *Runner) checkStat() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.process == nil {
 		return
 	}
 	if !time.Now().After(r.lastCheck.Add(4 * time.Second)) {
 		return
 	}
+	r.stat()
+}
 
+// stat refreshes the resource usage of the process, the caller holds r.lock.
+func (r *Runner) stat() {
 	handlers, _ := r.process.OpenFiles()
 	paths := []string{}
 	for _, handler := range handlers {
@@ -138,12 +213,28 @@ func (r *Runner) checkStat() {
 	fdNum, _ := r.process.NumFDs()
 	r.fdNum = int(fdNum)
 
+	threads, _ := r.process.NumThreads()
+	r.threads = int(threads)
+
 	mem, err := r.process.MemoryInfo()
 	if err == nil {
 		r.mem = int(mem.RSS)
 	}
-	cpu, _ := r.process.CPUPercent()
-	r.cpu = cpu
+	// cpu usage since the last check, or since the process started on the first one
+	if times, err := r.process.Times(); err == nil {
+		total := times.User + times.System
+		if !r.lastCheck.IsZero() {
+			r.cpu = 100 * (total - r.cpuTime) / time.Since(r.lastCheck).Seconds()
+		} else {
+			r.cpu, _ = r.process.CPUPercent()
+		}
+		r.cpuTime = total
+	}
+
+	if io, err := r.process.IOCounters(); err == nil {
+		r.readBytes = io.ReadBytes
+		r.writeBytes = io.WriteBytes
+	}
 
 	conns, err := r.process.Connections()
 	if err == nil {
@@ -159,61 +250,138 @@ func (r *Runner) checkStat() {
 	r.lastCheck = time.Now()
 }
 
+// Usage is the resource usage of the process at the last check.
+type Usage struct {
+	PID         int
+	Mem         int
+	CPU         float64
+	FDNum       int
+	Threads     int
+	Connections []string
+	Paths       []string
+}
+
+// Usage refreshes the resource usage at most every 4s and returns a copy of it.
+func (r *Runner) Usage() Usage {
+	if r == nil {
+		return Usage{}
+	}
+	r.checkStat()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	usage := Usage{Mem: r.mem, CPU: r.cpu, FDNum: r.fdNum, Threads: r.threads, Connections: r.connections, Paths: r.paths}
+	if r.process != nil {
+		usage.PID = int(r.process.Pid)
+	}
+	return usage
+}
+
+// outputDrainTimeout is how long the output of an exited process is waited
+// for before handing the exit to the supervisor.
+var outputDrainTimeout = time.Second
+
 func (r *Runner) Start() error {
 	if r.cmd.Process != nil && r.cmd.ProcessState != nil && r.cmd.ProcessState.Exited() {
 		return nil
 	}
-	stderr, err := r.cmd.StderrPipe()
+	// the pipes are not handed to cmd, so that waiting for the process does
+	// not wait for its children that keep them open
+	stderr, stderrW, err := os.Pipe()
 	if err != nil {
 		return err
 	}
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	go r.read(stderr, Stderr, &wg)
-	stdout, err := r.cmd.StdoutPipe()
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
+		stderr.Close()
+		stderrW.Close()
 		return err
 	}
+	r.cmd.Stdout, r.cmd.Stderr = stdoutW, stderrW
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go r.read(stderr, Stderr, &wg)
 	go r.read(stdout, Stdout, &wg)
-
+	drained := make(chan struct{})
 	go func() {
 		wg.Wait()
-		r.onStop()
+		close(drained)
 	}()
-	r.onStart()
-	if err := r.cmd.Start(); err != nil {
+
+	err = r.cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		close(r.started)
 		return err
 	}
+	r.run = r.history.Start(r.cmd.Process.Pid)
+	close(r.started)
+	r.cgroup = r.limits.apply(r.exec, r.cmd.Process.Pid)
+	r.onStart()
+	r.lifecycle(LifecycleStarted, "")
+	go func() {
+		err := r.cmd.Wait()
+		stopping := r.isStopping()
+		r.history.Exit(r.run, r.cmd.ProcessState, stopping)
+		if r.cgroup.oomKilled() {
+			r.history.SetReason(r.run, ExitOOMKilled)
+			err = ErrOOMKilled
+		}
+		r.cgroup.remove()
+		r.onStop()
+		switch {
+		case stopping:
+			r.lifecycle(LifecycleStopped, "")
+		case err != nil:
+			r.lifecycle(LifecycleCrashed, err.Error())
+		default:
+			r.lifecycle(LifecycleExited, "")
+		}
+		close(r.exited)
+		if !stopping && r.onExit != nil {
+			// let the last lines of the process come before a restart
+			select {
+			case <-drained:
+			case <-time.After(outputDrainTimeout):
+			}
+			r.onExit(err)
+		}
+	}()
 	if r.cmd.Process != nil {
 		p, err := process.NewProcess(int32(r.cmd.Process.Pid))
 		if err != nil {
 			return err
 		}
+		r.lock.Lock()
 		r.process = p
+		r.lock.Unlock()
+	}
+	if r.healthCheck != nil {
+		r.setHealth(HealthStarting)
+		go r.watchHealth()
 	}
 	return nil
 }
 
 var re = regexp.MustCompile(`@(\S+)`)
 
-func processConfig(args []string, meta map[string]string) {
-	if args == nil {
-		return
-	}
-	lo.ForEach(args, func(arg string, i int) {
-		results := re.FindAllString(arg, -1)
-		if len(results) >= 1 {
-			for _, result := range results {
-				err := ReplaceMetaFile(result, meta)
-				if err != nil {
-					continue
-				}
+// processConfig writes the meta files referenced in the args with the meta
+// variables replaced and returns the args pointing to the written files.
+func processConfig(service *Service, meta map[string]string) []string {
+	vars := lo.Assign(meta, service.replicaVars())
+	return lo.Map(service.Args, func(arg string, i int) string {
+		return re.ReplaceAllStringFunc(arg, func(file string) string {
+			target := service.metaFile(file)
+			if err := ReplaceMetaFile(file, target, vars); err != nil {
+				return file
 			}
-		}
+			return target
+		})
 	})
 }
 
-func ReplaceMetaFile(file string, metaVars map[string]string) error {
+// ReplaceMetaFile writes the file @name as target, with the meta variables replaced.
+func ReplaceMetaFile(file string, target string, metaVars map[string]string) error {
 	filePath := strings.TrimPrefix(file, "@")
 	data, err := os.ReadFile(path.Join("service", filePath))
 	if err != nil {
@@ -228,19 +396,19 @@ func ReplaceMetaFile(file string, metaVars map[string]string) error {
 		value := metaVars[key]
 		data = bytes.ReplaceAll(data, []byte(key), []byte(value))
 	}
-	os.WriteFile(path.Join("service", "@"+filePath), data, 0644)
+	os.WriteFile(path.Join("service", target), data, 0644)
 	return nil
 }
 
 func NewRunner(service *Service, mode Mode, meta map[string]string) *Runner {
-	processConfig(service.Args, meta)
+	args := processConfig(service, meta)
 	os.Chmod(service.ExecPath(), 0777)
 	exe := service.Exec
 	if !strings.HasPrefix(service.Exec, "./") {
 		exe = "./" + service.Exec
 	}
-	cmd := exec.Command(exe, service.Args...)
-	fmt.Println("$", exe, strings.Join(service.Args, " "))
+	cmd := exec.Command(exe, args...)
+	fmt.Println("$", exe, strings.Join(args, " "))
 	for _, env := range service.Env {
 		fmt.Println(" > ", env)
 	}
@@ -252,15 +420,31 @@ func NewRunner(service *Service, mode Mode, meta map[string]string) *Runner {
 	envs := append(os.Environ(), service.Env...)
 	cmd.Env = envs
 	cmd.SysProcAttr = ProcAttr()
+	stopSignal, _ := ParseStopSignal(service.StopSignal)
 
 	return &Runner{
 		cmd:  cmd,
 		name: service.Name,
-		exec: service.Exec,
+		exec: service.ID(),
 		mode: mode,
 
-		onStart: func() { service.Running = true },
-		onStop:  func() { service.Running = false },
+		onStart: func() { service.setRunning(true) },
+		onStop:  func() { service.setRunning(false) },
+		started: make(chan struct{}),
+		exited:  make(chan struct{}),
+
+		onStopped: func(result StopResult) {
+			service.lock.Lock()
+			service.lastStop = result
+			service.lock.Unlock()
+		},
+		history:     &service.runs,
+		logConfig:   service.Log,
+		stopSignal:  stopSignal,
+		stopTimeout: service.stopTimeout(),
+
+		healthCheck: service.Health,
+		limits:      service.Limits,
 
 		connections: []string{},
 		paths:       []string{},
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// RunNum is the number of runs kept per service.
+var RunNum = 20
+
+func init() {
+	numStr, _ := os.LookupEnv("RUN_NUM")
+	if numStr != "" {
+		newRunNum, _ := strconv.Atoi(numStr)
+		if newRunNum > 0 {
+			RunNum = newRunNum
+		}
+	}
+}
+
+// Run is one execution of a service's process.
+type Run struct {
+	ID    int       `json:"id"`
+	PID   int       `json:"pid"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// ExitCode is -1 while running or when the process was killed by a signal.
+	ExitCode int    `json:"exitCode"`
+	Signal   string `json:"signal,omitempty"`
+	// Reason is set when emu knows why the process ended, e.g. oom-killed.
+	Reason string `json:"reason,omitempty"`
+	// Stopped is set when emu asked the process to stop.
+	Stopped    bool          `json:"stopped"`
+	StopResult StopResult    `json:"stopResult,omitempty"`
+	Uptime     time.Duration `json:"uptime"`
+}
+
+func (run *Run) Running() bool {
+	return run.End.IsZero()
+}
+
+type RunHistory struct {
+	lock sync.Mutex
+	runs []*Run
+	next int
+}
+
+func (h *RunHistory) Start(pid int) *Run {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.next++
+	run := &Run{ID: h.next, PID: pid, Start: time.Now(), ExitCode: -1}
+	h.runs = append(h.runs, run)
+	if len(h.runs) > RunNum {
+		h.runs = h.runs[len(h.runs)-RunNum:]
+	}
+	return run
+}
+
+// Exit records how the process of the run ended.
+func (h *RunHistory) Exit(run *Run, state *os.ProcessState, stopped bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	run.End = time.Now()
+	run.Stopped = stopped
+	if state == nil {
+		return
+	}
+	run.ExitCode = state.ExitCode()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		run.Signal = status.Signal().String()
+	}
+}
+
+func (h *RunHistory) SetReason(run *Run, reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	run.Reason = reason
+}
+
+func (h *RunHistory) SetStopResult(run *Run, result StopResult) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	run.StopResult = result
+}
+
+// List returns copies of the runs, latest first.
+func (h *RunHistory) List() []Run {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	runs := make([]Run, 0, len(h.runs))
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		run := *h.runs[i]
+		if run.Running() {
+			run.Uptime = time.Since(run.Start)
+		} else {
+			run.Uptime = run.End.Sub(run.Start)
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// LastExitCode returns the exit code of the latest finished run.
+func (h *RunHistory) LastExitCode() *int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		if !h.runs[i].Running() {
+			code := h.runs[i].ExitCode
+			return &code
+		}
+	}
+	return nil
+}
+
+func RunsHandler(w http.ResponseWriter, r *http.Request) {
+	service := GetService(r)
+	render.JSON(w, r, NewData(service.runs.List()))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/samber/lo"
+)
+
+type StatsConfig struct {
+	Interval  time.Duration `yaml:"interval" json:"interval"`
+	Retention time.Duration `yaml:"retention" json:"retention"`
+}
+
+func (c *StatsConfig) interval() time.Duration {
+	if c != nil && c.Interval > 0 {
+		return c.Interval
+	}
+	return 10 * time.Second
+}
+
+func (c *StatsConfig) retention() time.Duration {
+	if c != nil && c.Retention > 0 {
+		return c.Retention
+	}
+	return 6 * time.Hour
+}
+
+// capacity is how many samples are kept, at least one.
+func (c *StatsConfig) capacity() int {
+	return lo.Max([]int{int(c.retention() / c.interval()), 1})
+}
+
+func (c *StatsConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Interval < 0 || c.Retention < 0 {
+		return fmt.Errorf("interval and retention cannot be negative")
+	}
+	if c.retention() < c.interval() {
+		return fmt.Errorf("retention %s is shorter than the interval %s", c.retention(), c.interval())
+	}
+	return nil
+}
+
+// Sample is the resource usage of a service's process at some point.
+type Sample struct {
+	Time        time.Time `json:"time"`
+	PID         int       `json:"pid"`
+	CPU         float64   `json:"cpu"`
+	RSS         int       `json:"rss"`
+	FDs         int       `json:"fds"`
+	Threads     int       `json:"threads"`
+	ReadBytes   uint64    `json:"readBytes"`
+	WriteBytes  uint64    `json:"writeBytes"`
+	Connections int       `json:"connections"`
+}
+
+func (r *Runner) sample() (Sample, bool) {
+	if r == nil {
+		return Sample{}, false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.process == nil {
+		return Sample{}, false
+	}
+	r.stat()
+	return Sample{
+		Time:        time.Now(),
+		PID:         int(r.process.Pid),
+		CPU:         r.cpu,
+		RSS:         r.mem,
+		FDs:         r.fdNum,
+		Threads:     r.threads,
+		ReadBytes:   r.readBytes,
+		WriteBytes:  r.writeBytes,
+		Connections: len(r.connections),
+	}, true
+}
+
+// SampleHistory is a ring buffer of the latest samples of a service.
+type SampleHistory struct {
+	samples []Sample
+	head    int
+	size    int
+}
+
+func NewSampleHistory(capacity int) *SampleHistory {
+	return &SampleHistory{samples: make([]Sample, capacity)}
+}
+
+// Resize changes the capacity, keeping the latest samples.
+func (h *SampleHistory) Resize(capacity int) {
+	samples := h.Since(time.Time{})
+	if len(samples) > capacity {
+		samples = samples[len(samples)-capacity:]
+	}
+	h.samples = make([]Sample, capacity)
+	copy(h.samples, samples)
+	h.size = len(samples)
+	h.head = h.size % capacity
+}
+
+func (h *SampleHistory) Add(sample Sample) {
+	h.samples[h.head] = sample
+	h.head = (h.head + 1) % len(h.samples)
+	if h.size < len(h.samples) {
+		h.size++
+	}
+}
+
+// Since returns the samples taken after t, oldest first.
+func (h *SampleHistory) Since(t time.Time) []Sample {
+	result := []Sample{}
+	start := (h.head - h.size + len(h.samples)) % len(h.samples)
+	for i := 0; i < h.size; i++ {
+		sample := h.samples[(start+i)%len(h.samples)]
+		if sample.Time.After(t) {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+func (s *Service) addSample(sample Sample, capacity int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stats == nil {
+		s.stats = NewSampleHistory(capacity)
+	} else if len(s.stats.samples) != capacity {
+		s.stats.Resize(capacity)
+	}
+	s.stats.Add(sample)
+}
+
+func (s *Service) Stats(since time.Time) []Sample {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stats == nil {
+		return []Sample{}
+	}
+	return s.stats.Since(since)
+}
+
+// Sample polls the processes of the running services forever.
+func (e *Engine) Sample(config func() *Config) {
+	for {
+		stats := config().Stats
+		interval := stats.interval()
+		capacity := stats.capacity()
+		for _, s := range e.Services() {
+			if !s.IsRunning() {
+				continue
+			}
+			if sample, ok := s.Runner().sample(); ok {
+				s.addSample(sample, capacity)
+				alerts.Check(s.ID(), sample)
+				hub.Publish(Topic(TopicStats, s.ID()), sample)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	service := GetService(r)
+	since := time.Hour
+	if value := r.URL.Query().Get("range"); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil {
+			render.JSON(w, r, NewError(err))
+			return
+		}
+	}
+	render.JSON(w, r, NewData(service.Stats(time.Now().Add(-since))))
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
+	"github.com/samber/lo"
 )
 
 type engineKey struct{}
@@ -28,25 +30,64 @@ func WithEngine(engine *Engine) func(next http.Handler) http.Handler {
 
 type serviceKey struct{}
 
+type replicasKey struct{}
+
+// RequireServiceMiddleware puts the service into the context, along with all
+// its replicas, or only the one selected with ?replica=.
 func RequireServiceMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		exec := chi.URLParam(r, "service")
 		engine := GetEngine(r)
-		service := engine.GetService(exec)
-		if service == nil {
+		replicas := engine.GetReplicas(exec)
+		if len(replicas) == 0 {
 			render.JSON(w, r, NewError(ErrServiceNotFound))
 			return
 		}
+		if index := r.URL.Query().Get("replica"); index != "" {
+			replicas = lo.Filter(replicas, func(s *Service, i int) bool { return strconv.Itoa(s.index) == index })
+			if len(replicas) == 0 {
+				render.JSON(w, r, NewError(ErrReplicaNotFound))
+				return
+			}
+		}
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, serviceKey{}, service)
+		ctx = context.WithValue(ctx, serviceKey{}, replicas[0])
+		ctx = context.WithValue(ctx, replicasKey{}, replicas)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// GetService returns the service in the URL, its first replica when it has
+// several and none is selected.
 func GetService(r *http.Request) *Service {
 	return r.Context().Value(serviceKey{}).(*Service)
 }
 
+func GetReplicas(r *http.Request) []*Service {
+	return r.Context().Value(replicasKey{}).([]*Service)
+}
+
+// eachReplica calls action with the id of every replica of the request.
+func eachReplica(r *http.Request, action func(id string) error) error {
+	errs := []string{}
+	for _, s := range GetReplicas(r) {
+		if err := action(s.ID()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.ID(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func replicaDetail(r *http.Request) string {
+	if index := r.URL.Query().Get("replica"); index != "" {
+		return "replica " + index
+	}
+	return ""
+}
+
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	engine := GetEngine(r)
 	service := GetService(r)
@@ -70,51 +111,77 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if uploadErr != nil {
 		fmt.Println("file size:", fileHeader.Size)
+		metrics.AddUpload(service.Exec, uploadErr)
+		alerts.UploadFailed(service.Exec, uploadErr)
+		publishLifecycle(LifecycleEvent{Service: service.Exec, Step: LifecycleUploadFailed, Message: uploadErr.Error()})
+		Audit(r, "upload", "", uploadErr)
 		render.JSON(w, r, NewError(uploadErr))
 		return
 	}
-	if service.Packed() {
-		serviceFolder := service.ServiceFolder()
-		if _, err := os.Stat(serviceFolder); err == nil {
-			os.RemoveAll(serviceFolder + ".bak")
-			os.Rename(serviceFolder, serviceFolder+".bak")
-		}
-
-	} else {
-		// 如果是二进制文件
-		if _, err := CopyFile(service.ExecPath(), service.ExecPath()+".bak"); err != nil {
-			render.JSON(w, r, err)
-			return
-		}
+	release, err := releases.Add(service, filename, GetUser(r))
+	if err != nil {
+		metrics.AddUpload(service.Exec, err)
+		alerts.UploadFailed(service.Exec, err)
+		publishLifecycle(LifecycleEvent{Service: service.Exec, Step: LifecycleUploadFailed, Message: err.Error()})
+		Audit(r, "upload", "", err)
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	publishLifecycle(LifecycleEvent{Service: service.Exec, Step: LifecycleUploaded, Message: fmt.Sprintf("release %d", release.ID)})
+	deploy := engine.Deploy
+	if service.Deploy.safe() {
+		deploy = engine.SafeDeploy
 	}
+	err = deploy(service, release)
+	metrics.AddUpload(service.Exec, err)
+	alerts.UploadFailed(service.Exec, err)
+	Audit(r, "upload", fmt.Sprintf("release %d", release.ID), err)
+	if err != nil {
+		publishLifecycle(LifecycleEvent{Service: service.Exec, Step: LifecycleUploadFailed, Message: err.Error()})
+		render.JSON(w, r, Resp{Data: release, Err: err.Error()})
+		return
+	}
+	publishLifecycle(LifecycleEvent{Service: service.Exec, Step: LifecycleDeployed, Message: fmt.Sprintf("release %d", release.ID)})
+	render.JSON(w, r, NewData(release))
+}
 
-	engine.StopService(service.Exec)
+func ReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	service := GetService(r)
+	history, err := releases.List(service)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(history))
+}
 
-	if service.Packed() {
-		// 如果是压缩包，直接解压
-		serviceFolder := service.ServiceFolder()
-		if err := ExtractTarGz(filename, serviceFolder); err != nil {
-			render.JSON(w, r, NewError(err))
-			return
-		}
-	} else {
-		// 如果是二进制文件，需要手动覆盖
-		if err := os.Rename(filename, service.ExecPath()); err != nil {
-			render.JSON(w, r, NewError(err))
-			return
-		}
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	engine := GetEngine(r)
+	service := GetService(r)
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		render.JSON(w, r, NewError(ErrReleaseNotFound))
+		return
 	}
-	if err := engine.StartService(service.Exec); err != nil {
+	release, err := releases.Get(service, id)
+	if err != nil {
 		render.JSON(w, r, NewError(err))
 		return
 	}
-	render.JSON(w, r, NewData(nil))
+	err = engine.Deploy(service, release)
+	Audit(r, "rollback", fmt.Sprintf("release %d", release.ID), err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(release))
 }
 
 func StartHandler(w http.ResponseWriter, r *http.Request) {
 	engine := GetEngine(r)
-	service := GetService(r)
-	if err := engine.StartService(service.Exec); err != nil {
+	err := eachReplica(r, engine.StartService)
+	Audit(r, "start", replicaDetail(r), err)
+	if err != nil {
 		render.JSON(w, r, NewError(err))
 		return
 	}
@@ -123,8 +190,9 @@ func StartHandler(w http.ResponseWriter, r *http.Request) {
 
 func StopHandler(w http.ResponseWriter, r *http.Request) {
 	engine := GetEngine(r)
-	service := GetService(r)
-	if err := engine.StopService(service.Exec); err != nil {
+	err := eachReplica(r, engine.StopService)
+	Audit(r, "stop", replicaDetail(r), err)
+	if err != nil {
 		render.JSON(w, r, NewError(err))
 		return
 	}
@@ -133,8 +201,9 @@ func StopHandler(w http.ResponseWriter, r *http.Request) {
 
 func RestartHandler(w http.ResponseWriter, r *http.Request) {
 	engine := GetEngine(r)
-	service := GetService(r)
-	if err := engine.Restart(service.Exec); err != nil {
+	err := eachReplica(r, engine.Restart)
+	Audit(r, "restart", replicaDetail(r), err)
+	if err != nil {
 		render.JSON(w, r, NewError(err))
 		return
 	}
@@ -148,10 +217,15 @@ func GetConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 func GetOutputHandler(w http.ResponseWriter, r *http.Request) {
 	service := GetService(r)
+	options, err := ParseOutputOptions(r)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		render.JSON(w, r, NewError(err))
 		return
 	}
-	hub.Join(service.Exec, conn)
+	hub.Join(Topic(TopicOutput, service.ID()), conn, options)
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/render"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrExecChanged = fmt.Errorf("the exec of a service cannot be changed, delete it and create a new one")
+
+// EditServices rewrites the services section of the config file with edit,
+// working on yaml nodes so that comments and ordering are kept, then applies
+// the result like a reload. The file is only replaced if the new config is valid.
+func (r *Reloader) EditServices(edit func(services *yaml.Node) error) (*ReloadSummary, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config is not a yaml mapping")
+	}
+	if err := edit(servicesNode(doc.Content[0])); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+
+	// the config holds password hashes, keep it as private as it was
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if _, err := readConfigFromFile(tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return nil, err
+	}
+	return r.reload()
+}
+
+// servicesNode returns the services sequence of the config mapping, creating it if needed.
+func servicesNode(config *yaml.Node) *yaml.Node {
+	for i := 0; i+1 < len(config.Content); i += 2 {
+		if config.Content[i].Value == "services" {
+			services := config.Content[i+1]
+			if services.Kind != yaml.SequenceNode {
+				*services = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			}
+			return services
+		}
+	}
+	services := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	config.Content = append(config.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "services"}, services)
+	return services
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func findServiceNode(services *yaml.Node, exec string) int {
+	for i, item := range services.Content {
+		if value := mappingValue(item, "exec"); value != nil && value.Value == exec {
+			return i
+		}
+	}
+	return -1
+}
+
+// serviceNode encodes the service, leaving out empty fields.
+func serviceNode(service *Service) (*yaml.Node, error) {
+	var node yaml.Node
+	if err := node.Encode(service); err != nil {
+		return nil, err
+	}
+	pruneNode(&node)
+	return &node, nil
+}
+
+// pruneNode removes the keys with zero values from a mapping, and from the
+// mappings it holds directly or in sequences.
+func pruneNode(node *yaml.Node) {
+	content := []*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		value := node.Content[i+1]
+		switch value.Kind {
+		case yaml.MappingNode:
+			pruneNode(value)
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item.Kind == yaml.MappingNode {
+					pruneNode(item)
+				}
+			}
+		}
+		switch {
+		case value.Tag == "!!null", value.Kind != yaml.ScalarNode && len(value.Content) == 0:
+			continue
+		case value.Kind == yaml.ScalarNode && lo.Contains([]string{"", "0", "0s", "false"}, value.Value):
+			continue
+		}
+		content = append(content, node.Content[i], value)
+	}
+	node.Content = content
+}
+
+// mergeNode updates the mapping dst with src in place, keeping the comments of dst.
+func mergeNode(dst *yaml.Node, src *yaml.Node) {
+	content := []*yaml.Node{}
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		if value := mappingValue(src, dst.Content[i].Value); value != nil {
+			value.HeadComment = dst.Content[i+1].HeadComment
+			value.LineComment = dst.Content[i+1].LineComment
+			content = append(content, dst.Content[i], value)
+		}
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		if mappingValue(dst, src.Content[i].Value) == nil {
+			content = append(content, src.Content[i], src.Content[i+1])
+		}
+	}
+	dst.Content = content
+}
+
+func decodeService(r *http.Request) (*Service, *yaml.Node, error) {
+	service := &Service{}
+	if err := render.DecodeJSON(r.Body, service); err != nil {
+		return nil, nil, err
+	}
+	if err := service.Validate(); err != nil {
+		return nil, nil, err
+	}
+	node, err := serviceNode(service)
+	return service, node, err
+}
+
+func (rl *Reloader) CreateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	service, node, err := decodeService(r)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	summary, err := rl.EditServices(func(services *yaml.Node) error {
+		if findServiceNode(services, service.Exec) >= 0 {
+			return fmt.Errorf("service %s already exists", service.Exec)
+		}
+		services.Content = append(services.Content, node)
+		return nil
+	})
+	Audit(r, "create-service", service.Exec, err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(summary))
+}
+
+// UpdateServiceHandler replaces the whole definition of the service with the
+// body: the fields left out are removed from the config. The exec identifies
+// the service and cannot be changed.
+func (rl *Reloader) UpdateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	current := GetService(r)
+	service, node, err := decodeService(r)
+	if err == nil && service.Exec != current.Exec {
+		err = ErrExecChanged
+	}
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	summary, err := rl.EditServices(func(services *yaml.Node) error {
+		i := findServiceNode(services, current.Exec)
+		if i < 0 {
+			return ErrServiceNotFound
+		}
+		mergeNode(services.Content[i], node)
+		return nil
+	})
+	Audit(r, "update-service", current.Exec, err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(summary))
+}
+
+func (rl *Reloader) DeleteServiceHandler(w http.ResponseWriter, r *http.Request) {
+	service := GetService(r)
+	summary, err := rl.EditServices(func(services *yaml.Node) error {
+		i := findServiceNode(services, service.Exec)
+		if i < 0 {
+			return ErrServiceNotFound
+		}
+		services.Content = append(services.Content[:i], services.Content[i+1:]...)
+		return nil
+	})
+	Audit(r, "delete-service", "", err)
+	if err != nil {
+		render.JSON(w, r, NewError(err))
+		return
+	}
+	render.JSON(w, r, NewData(summary))
+}
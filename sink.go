@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SinkEntry is a record of a service's output sent to a sink.
+type SinkEntry struct {
+	Service string `json:"service"`
+	LogRecord
+}
+
+// LogSink ships batches of output records somewhere outside emu.
+type LogSink interface {
+	Send(entries []SinkEntry) error
+}
+
+type SinkConfig struct {
+	// Type is one of stdout, http, loki or syslog.
+	Type string `yaml:"type" json:"type"`
+	// URL is the endpoint of http and loki sinks, or udp://host:port or tcp://host:port for syslog.
+	URL     string            `yaml:"url" json:"-"`
+	Headers map[string]string `yaml:"headers,omitempty" json:"-"`
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels"`
+
+	BatchSize     int           `yaml:"batch-size" json:"batchSize"`
+	FlushInterval time.Duration `yaml:"flush-interval" json:"flushInterval"`
+	BufferSize    int           `yaml:"buffer-size" json:"bufferSize"`
+	MaxRetries    int           `yaml:"max-retries" json:"maxRetries"`
+}
+
+func (c *SinkConfig) Validate() error {
+	switch c.Type {
+	case "stdout":
+		return nil
+	case "http", "loki", "syslog":
+		if c.URL == "" {
+			return fmt.Errorf("%s sink needs an url", c.Type)
+		}
+		if c.Type != "syslog" {
+			return nil
+		}
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") {
+			return fmt.Errorf("syslog sink url must be udp://host:port or tcp://host:port")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown sink type %q", c.Type)
+}
+
+func (c *SinkConfig) sink() LogSink {
+	switch c.Type {
+	case "http":
+		return &HTTPSink{URL: c.URL, Headers: c.Headers}
+	case "loki":
+		return &LokiSink{URL: c.URL, Headers: c.Headers, Labels: c.Labels}
+	case "syslog":
+		u, _ := url.Parse(c.URL)
+		return &SyslogSink{Network: u.Scheme, Addr: u.Host}
+	}
+	return &StdoutSink{}
+}
+
+// batchSink buffers entries and sends them to the sink in batches, retrying failed ones.
+type batchSink struct {
+	config  *SinkConfig
+	sink    LogSink
+	entries chan SinkEntry
+	done    chan struct{}
+	dropped int64
+}
+
+func newBatchSink(config *SinkConfig) *batchSink {
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 10000
+	}
+	b := &batchSink{
+		config:  config,
+		sink:    config.sink(),
+		entries: make(chan SinkEntry, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Write never blocks, entries are dropped when the buffer is full.
+func (b *batchSink) Write(entry SinkEntry) {
+	select {
+	case b.entries <- entry:
+	default:
+		if atomic.AddInt64(&b.dropped, 1)%1000 == 1 {
+			fmt.Println(b.config.Type, "sink buffer full, dropping records")
+		}
+	}
+}
+
+func (b *batchSink) run() {
+	defer close(b.done)
+	batchSize := b.config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	interval := b.config.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := []SinkEntry{}
+	for {
+		select {
+		case entry, ok := <-b.entries:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		b.flush(batch)
+		batch = []SinkEntry{}
+	}
+}
+
+func (b *batchSink) flush(batch []SinkEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	maxRetries := b.config.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := b.sink.Send(batch)
+		if err == nil {
+			return
+		}
+		if attempt >= maxRetries {
+			fmt.Println(b.config.Type, "sink dropped", len(batch), "records:", err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Close sends what is left in the buffer and stops the sink.
+func (b *batchSink) Close() {
+	close(b.entries)
+	<-b.done
+}
+
+// LogSinks routes the output of services and jobs to the global sinks and their own ones.
+type LogSinks struct {
+	lock     sync.RWMutex
+	global   []*batchSink
+	services map[string][]*batchSink
+}
+
+var sinks = LogSinks{}
+
+// Configure replaces the sinks with the ones of the config.
+func (s *LogSinks) Configure(config *Config) {
+	global := []*batchSink{}
+	for _, c := range config.Sinks {
+		global = append(global, newBatchSink(c))
+	}
+	services := map[string][]*batchSink{}
+	for _, service := range config.Services {
+		for _, c := range service.Sinks {
+			services[service.ID()] = append(services[service.ID()], newBatchSink(c))
+		}
+	}
+	for _, job := range config.Jobs {
+		for _, c := range job.Sinks {
+			services[job.ID()] = append(services[job.ID()], newBatchSink(c))
+		}
+	}
+
+	s.lock.Lock()
+	old := s.global
+	for _, bs := range s.services {
+		old = append(old, bs...)
+	}
+	s.global = global
+	s.services = services
+	s.lock.Unlock()
+
+	for _, b := range old {
+		b.Close()
+	}
+}
+
+func (s *LogSinks) Write(service string, record LogRecord) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entry := SinkEntry{Service: service, LogRecord: record}
+	for _, b := range s.global {
+		b.Write(entry)
+	}
+	for _, b := range s.services[service] {
+		b.Write(entry)
+	}
+}
+
+func (s *LogSinks) Close() {
+	s.Configure(&Config{})
+}
+
+// StdoutSink prints the records on the output of emu itself.
+type StdoutSink struct{}
+
+func (s *StdoutSink) Send(entries []SinkEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "[%s] %s\n", entry.Service, entry.Line)
+	}
+	_, err := os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+func postJSON(url string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// HTTPSink posts each batch as a JSON array of entries.
+type HTTPSink struct {
+	URL     string
+	Headers map[string]string
+}
+
+func (s *HTTPSink) Send(entries []SinkEntry) error {
+	return postJSON(s.URL, s.Headers, entries)
+}
+
+// LokiSink pushes batches to the Loki push API, labelled by service and stream.
+type LokiSink struct {
+	URL     string
+	Headers map[string]string
+	Labels  map[string]string
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (s *LokiSink) Send(entries []SinkEntry) error {
+	streams := []*lokiStream{}
+	byKey := map[string]*lokiStream{}
+	for _, entry := range entries {
+		key := entry.Service + "/" + string(entry.Stream) + "/" + entry.Level
+		stream, ok := byKey[key]
+		if !ok {
+			labels := map[string]string{"service": entry.Service, "stream": string(entry.Stream)}
+			if entry.Level != "" {
+				labels["level"] = entry.Level
+			}
+			for k, v := range s.Labels {
+				labels[k] = v
+			}
+			stream = &lokiStream{Stream: labels}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.Time.UnixNano(), 10), entry.Line})
+	}
+	return postJSON(s.URL, s.Headers, map[string]interface{}{"streams": streams})
+}
+
+// SyslogSink sends RFC 5424 messages over UDP, or TCP with octet counting framing.
+type SyslogSink struct {
+	Network string
+	Addr    string
+}
+
+func syslogSeverity(entry SinkEntry) int {
+	switch entry.Level {
+	case "fatal", "panic", "dpanic", "critical":
+		return 2
+	case "error", "err":
+		return 3
+	case "warn", "warning":
+		return 4
+	case "info":
+		return 6
+	case "debug", "trace":
+		return 7
+	}
+	if entry.Stream == Stderr {
+		return 3
+	}
+	return 6
+}
+
+func (s *SyslogSink) format(hostname string, entry SinkEntry) string {
+	// facility user
+	pri := 1*8 + syslogSeverity(entry)
+	return fmt.Sprintf("<%d>1 %s %s %s - %s - %s", pri, entry.Time.Format(time.RFC3339Nano),
+		hostname, strings.ReplaceAll(entry.Service, " ", "_"), entry.Stream, entry.Line)
+}
+
+func (s *SyslogSink) Send(entries []SinkEntry) error {
+	conn, err := net.DialTimeout(s.Network, s.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	hostname, _ := os.Hostname()
+	for _, entry := range entries {
+		msg := s.format(hostname, entry)
+		if s.Network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type StopResult string
+
+var (
+	StopGraceful StopResult = "graceful"
+	StopForced   StopResult = "forced"
+)
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+// ParseStopSignal accepts SIGTERM, SIGINT or SIGQUIT, with or without the SIG prefix.
+// The default is SIGINT.
+func ParseStopSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGINT, nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := stopSignals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported stop signal %q", name)
+	}
+	return sig, nil
+}
+
+func (s *Service) stopTimeout() time.Duration {
+	if s.StopTimeout > 0 {
+		return s.StopTimeout
+	}
+	return 10 * time.Second
+}
+
+func (s *Service) LastStop() StopResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastStop
+}
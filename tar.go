@@ -21,6 +21,9 @@ func ExtractTarGz(fileName string, dest string) error {
 	}
 	defer gzipReader.Close()
 
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
 	tarReader := tar.NewReader(gzipReader)
 
 	for {
@@ -34,7 +37,7 @@ func ExtractTarGz(fileName string, dest string) error {
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// handle directory
-			if err := os.Mkdir(filepath.Join(dest, header.Name), 0755); err != nil {
+			if err := os.MkdirAll(filepath.Join(dest, header.Name), 0755); err != nil {
 				return err
 			}
 		case tar.TypeReg:
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/samber/lo"
 )
 
 var upgrader = websocket.Upgrader{
@@ -24,12 +29,11 @@ var hub = NotificationHub{}
 var LogNum = 200
 
 func init() {
-	hub.client2channel = make(map[*websocket.Conn]string)
-	hub.clients = make(map[string][]*websocket.Conn)
-	hub.msgC = make(chan Msg, 100)
-	hub.sendAllC = make(chan SendAll, 10)
+	hub.clients = make(map[*Client]bool)
+	hub.buffers = make(map[string]*CircularBuffer)
+	hub.eventC = make(chan Event, 100)
+	hub.subscribeC = make(chan subscription, 10)
 	hub.closeC = make(chan struct{})
-	hub.loggers = make(map[string]*CircularBuffer)
 	numStr, _ := os.LookupEnv("LOG_NUM")
 	if numStr != "" {
 		newLogNum, _ := strconv.Atoi(numStr)
@@ -39,123 +43,317 @@ func init() {
 	}
 }
 
-type NotificationHub struct {
-	clients map[string][]*websocket.Conn
+// A topic is a kind followed by /key, the id of a service or of a rollout.
+const (
+	TopicOutput    = "output"
+	TopicLifecycle = "lifecycle"
+	TopicStats     = "stats"
+	TopicRollout   = "rollout"
+)
 
-	client2channel map[*websocket.Conn]string
+var topicKinds = []string{TopicOutput, TopicLifecycle, TopicStats, TopicRollout}
 
-	loggers map[string]*CircularBuffer
+// bufferedKinds keep their last LogNum events, sent to the clients subscribing to the topic.
+var bufferedKinds = []string{TopicOutput, TopicRollout}
 
-	lock     sync.RWMutex
-	msgC     chan Msg
-	sendAllC chan SendAll
-	closeC   chan struct{}
+func Topic(kind string, key string) string {
+	return kind + "/" + key
 }
 
-type Msg struct {
-	Content string
-	Channel string
+func splitTopic(topic string) (string, string) {
+	kind, key, _ := strings.Cut(topic, "/")
+	return kind, key
 }
 
-type SendAll struct {
-	Channel string
-	client  *websocket.Conn
+// topicMatches reports whether subscribing to pattern gets the events of topic.
+// The pattern is a topic, a kind for all its topics, or a kind and an exec for
+// all the replicas of the service.
+func topicMatches(pattern string, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	kind, key := splitTopic(topic)
+	patternKind, patternKey := splitTopic(pattern)
+	if kind != patternKind {
+		return false
+	}
+	exec, _ := splitID(key)
+	return patternKey == "" || patternKey == "*" || patternKey == exec
 }
 
-func (h *NotificationHub) Join(channel string, conn *websocket.Conn) {
-	h.lock.Lock()
-	h.client2channel[conn] = channel
-	h.clients[channel] = append(h.clients[channel], conn)
-	h.lock.Unlock()
+// Event is published on a topic of the hub.
+type Event struct {
+	Topic string      `json:"topic"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
 
-	hub.sendAllC <- SendAll{Channel: channel, client: conn}
+type frame struct {
+	kind string
+	data []byte
 }
 
-func (h *NotificationHub) Leave(conn *websocket.Conn) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	channel, exist := h.client2channel[conn]
-	if !exist {
-		return
-	}
-	delete(h.client2channel, conn)
-	clients := []*websocket.Conn{}
+// Client is a websocket or SSE connection subscribed to some topics. The hub
+// queues its frames, which are written by its own goroutine.
+type Client struct {
+	// write sends a frame of the kind of its topic.
+	write func(kind string, data []byte) error
+	// close ends the connection.
+	close func()
+	// allow filters the topics the client may receive, all of them when nil.
+	allow   func(topic string) bool
+	options *OutputOptions
+	// raw clients get the bare output lines or event data instead of events.
+	raw bool
 
-	for _, c := range h.clients[channel] {
-		if c != conn {
-			clients = append(clients, c)
+	topics []string
+	left   bool
+	queue  chan frame
+	done   chan struct{}
+}
+
+func NewClient(write func(kind string, data []byte) error, close func(), options *OutputOptions) *Client {
+	c := &Client{write: write, close: close, options: options, queue: make(chan frame, LogNum), done: make(chan struct{})}
+	go c.run()
+	return c
+}
+
+// wsClient writes the frames to a websocket connection.
+func wsClient(conn *websocket.Conn, options *OutputOptions) *Client {
+	return NewClient(func(kind string, data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}, func() { conn.Close() }, options)
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	failed := false
+	for f := range c.queue {
+		if failed {
+			continue
+		}
+		if err := c.write(f.kind, f.data); err != nil {
+			fmt.Println("failed to write", err)
+			failed = true
+			c.close()
+			// keep draining the queue until the hub lets go of the client
+			go hub.Leave(c)
 		}
 	}
+}
 
-	h.clients[channel] = clients
+// send queues a frame, giving up on a client too slow to drain its queue.
+func (c *Client) send(event Event) bool {
+	data := c.frame(event)
+	if data == nil {
+		return true
+	}
+	kind, _ := splitTopic(event.Topic)
+	f := frame{kind: kind, data: data}
+	select {
+	case c.queue <- f:
+		return true
+	default:
+	}
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case c.queue <- f:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
 
-func (h *NotificationHub) sendAll(client *websocket.Conn, channel string) {
-	logger := h.loggers[channel]
-	if logger == nil {
-		return
+// frame formats the event for the client, or returns nil when its options filter it out.
+func (c *Client) frame(event Event) []byte {
+	record, isRecord := event.Data.(LogRecord)
+	if isRecord && !c.options.Match(record) {
+		return nil
+	}
+	if !c.raw {
+		data, _ := json.Marshal(event)
+		return data
 	}
+	if isRecord {
+		return c.options.Frame(record)
+	}
+	data, _ := json.Marshal(event.Data)
+	return append(data, '\n')
+}
 
-	for _, msg := range logger.GetAll() {
-		client.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
-		client.WriteMessage(websocket.TextMessage, msg)
+func (c *Client) subscribed(topic string) bool {
+	if c.allow != nil && !c.allow(topic) {
+		return false
 	}
+	return lo.ContainsBy(c.topics, func(pattern string) bool { return topicMatches(pattern, topic) })
 }
 
-func (h *NotificationHub) broadcast(channel string, msg []byte) {
-	h.lock.RLock()
+type NotificationHub struct {
+	clients map[*Client]bool
+	buffers map[string]*CircularBuffer
+
+	lock       sync.RWMutex
+	eventC     chan Event
+	subscribeC chan subscription
+	closeC     chan struct{}
+	dropped    int64
+}
+
+type subscription struct {
+	client *Client
+	topics []string
+}
+
+// Publish sends data to the clients subscribed to the topic. It never blocks,
+// so a hub busy with slow clients does not hold up the services' output:
+// events are dropped when the hub is behind.
+func (h *NotificationHub) Publish(topic string, data interface{}) {
+	select {
+	case h.eventC <- Event{Topic: topic, Time: time.Now(), Data: data}:
+	default:
+		if atomic.AddInt64(&h.dropped, 1)%1000 == 1 {
+			fmt.Println("hub is behind, dropping events")
+		}
+	}
+}
+
+// forget is the data of the event deleting the buffer of its topic.
+type forget struct{}
+
+// Forget deletes the buffer of a topic that is gone, once the events already
+// published on it have gone through.
+func (h *NotificationHub) Forget(topic string) {
+	h.eventC <- Event{Topic: topic, Data: forget{}}
+}
+
+// Subscribe adds topics to the client, sending it the buffered events of the new topics first.
+func (h *NotificationHub) Subscribe(client *Client, topics ...string) {
+	h.subscribeC <- subscription{client: client, topics: topics}
+}
 
-	closed := []*websocket.Conn{}
-	clients := h.clients[channel]
-	if len(clients) == 0 {
-		h.lock.RUnlock()
+func (h *NotificationHub) Unsubscribe(client *Client, topics ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	client.topics = lo.Without(client.topics, topics...)
+}
+
+// Join subscribes a websocket to the raw frames of a single topic.
+func (h *NotificationHub) Join(topic string, conn *websocket.Conn, options *OutputOptions) {
+	client := wsClient(conn, options)
+	client.raw = true
+	h.Subscribe(client, topic)
+}
+
+// Leave drops the client, which is done writing once client.done is closed.
+func (h *NotificationHub) Leave(client *Client) {
+	h.lock.Lock()
+	if client.left {
+		h.lock.Unlock()
 		return
 	}
-	for _, c := range clients {
-		c.SetWriteDeadline(time.Now().Add(time.Second))
-		writer, err := c.NextWriter(websocket.TextMessage)
-		if err != nil {
-			fmt.Println("failed to write", err)
-			closed = append(closed, c)
-		} else {
-			writer.Write(msg)
+	client.left = true
+	delete(h.clients, client)
+	close(client.queue)
+	h.lock.Unlock()
+}
+
+func (h *NotificationHub) subscribe(sub subscription) {
+	client := sub.client
+	h.lock.Lock()
+	if client.left {
+		h.lock.Unlock()
+		return
+	}
+	h.clients[client] = true
+	added := lo.Without(lo.Uniq(sub.topics), client.topics...)
+	client.topics = append(client.topics, added...)
+	h.lock.Unlock()
+
+	h.lock.RLock()
+	topics := lo.Keys(h.buffers)
+	sort.Strings(topics)
+	ok := true
+	for _, pattern := range added {
+		// backfilling whole kinds would flood the client
+		if _, key := splitTopic(pattern); key == "" || key == "*" {
+			continue
+		}
+		for _, topic := range topics {
+			if !ok || !topicMatches(pattern, topic) || (client.allow != nil && !client.allow(topic)) {
+				continue
+			}
+			for _, event := range client.options.backfill(h.buffers[topic].GetAll()) {
+				if ok = client.send(event); !ok {
+					break
+				}
+			}
 		}
 	}
 	h.lock.RUnlock()
-	if len(closed) > 0 {
-		for _, c := range closed {
-			h.Leave(c)
-			c.Close()
+	if !ok {
+		h.drop(client)
+	}
+}
+
+func (h *NotificationHub) broadcast(event Event) {
+	h.lock.RLock()
+	slow := []*Client{}
+	for c := range h.clients {
+		if c.subscribed(event.Topic) && !c.send(event) {
+			slow = append(slow, c)
 		}
 	}
+	h.lock.RUnlock()
+	for _, c := range slow {
+		h.drop(c)
+	}
+}
+
+func (h *NotificationHub) drop(client *Client) {
+	fmt.Println("dropping slow client")
+	client.close()
+	h.Leave(client)
 }
 
 func (h *NotificationHub) Close() {
 	close(h.closeC)
 }
 
-func (h *NotificationHub) Reset(channel string) {
-	logger, ok := h.loggers[channel]
-	if ok {
-		logger.Reset()
+// Reset empties the buffer of the topic.
+func (h *NotificationHub) Reset(topic string) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if buffer, ok := h.buffers[topic]; ok {
+		buffer.Reset()
 	}
 }
 
 func (h *NotificationHub) Start() {
 	for {
 		select {
-		case msg := <-h.msgC:
-			logger := h.loggers[msg.Channel]
-			if logger == nil {
-				logger = NewCircularBuffer(LogNum)
-				h.loggers[msg.Channel] = logger
+		case event := <-h.eventC:
+			if _, ok := event.Data.(forget); ok {
+				h.lock.Lock()
+				delete(h.buffers, event.Topic)
+				h.lock.Unlock()
+				continue
+			}
+			if kind, _ := splitTopic(event.Topic); lo.Contains(bufferedKinds, kind) {
+				h.lock.Lock()
+				buffer := h.buffers[event.Topic]
+				if buffer == nil {
+					buffer = NewCircularBuffer(LogNum)
+					h.buffers[event.Topic] = buffer
+				}
+				h.lock.Unlock()
+				buffer.Write(event)
 			}
-			data := []byte(msg.Content)
-			logger.Write(data)
-			h.broadcast(msg.Channel, data)
+			h.broadcast(event)
 
-		case sendAll := <-h.sendAllC:
-			h.sendAll(sendAll.client, sendAll.Channel)
+		case sub := <-h.subscribeC:
+			h.subscribe(sub)
 
 		case <-h.closeC:
 			return
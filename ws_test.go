@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestHub(size int) *NotificationHub {
+	return &NotificationHub{
+		clients:    map[*Client]bool{},
+		buffers:    map[string]*CircularBuffer{},
+		eventC:     make(chan Event, size),
+		subscribeC: make(chan subscription),
+		closeC:     make(chan struct{}),
+	}
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	h := newTestHub(1)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			h.Publish(Topic(TopicOutput, "api"), i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a hub that is behind")
+	}
+	if h.dropped != 9 {
+		t.Errorf("dropped %d events, want 9", h.dropped)
+	}
+}
+
+func TestForget(t *testing.T) {
+	h := newTestHub(0)
+	go h.Start()
+	defer h.Close()
+
+	// the hub is unbuffered, so each send waits for the previous event to be handled
+	h.eventC <- Event{Topic: Topic(TopicRollout, "1"), Data: "step"}
+	h.eventC <- Event{Topic: Topic(TopicOutput, "api"), Data: "line"}
+	h.Forget(Topic(TopicRollout, "1"))
+	h.Forget(Topic(TopicRollout, "2"))
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if _, ok := h.buffers[Topic(TopicRollout, "1")]; ok {
+		t.Error("the buffer of the forgotten topic is kept")
+	}
+	if _, ok := h.buffers[Topic(TopicOutput, "api")]; !ok {
+		t.Error("the buffer of another topic is deleted")
+	}
+}